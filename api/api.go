@@ -1,7 +1,6 @@
 package api
 
 import (
-	"database/sql"
 	"fmt"
 	"github.com/codegangsta/martini"
 	"github.com/codegangsta/martini-contrib/encoder"
@@ -10,22 +9,37 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 )
 
-func RunWeb(ip string, port int, monitors map[string]interface{}) {
+// RunWeb serves monitors, keyed by their api key, on ip and port until
+// serving fails.
+func RunWeb(ip string, port int, monitors map[string]*index.Monitor) {
+	handler := Handler(func(key string) (*index.Monitor, func()) {
+		return monitors[key], func() {}
+	})
+	fmt.Println(http.ListenAndServe(fmt.Sprint(ip, ":", port), handler))
+}
+
+// Handler serves the api of the monitors that monitor returns by api key,
+// nil for an unknown key. Monitors can come and go while it serves, a
+// request keeps the monitor it started with, and calls the release func
+// monitor returned with it once it is done.
+func Handler(monitor func(key string) (*index.Monitor, func())) http.Handler {
 	m := martini.New()
 	route := martini.NewRouter()
 
 	// validate an api key
-	m.Use(func(res http.ResponseWriter, req *http.Request) {
-		authKey := req.Header.Get("AUTH_KEY")
-		if monitors[authKey] == nil {
+	m.Use(func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		found, release := monitor(req.Header.Get("AUTH_KEY"))
+		if found == nil {
 			res.WriteHeader(http.StatusUnauthorized)
 			res.Write([]byte("Unauthorized access."))
-		} else {
-			monitored, _ := monitors[authKey].(string)
-			req.Header.Set("MONITORED", monitored)
+			return
 		}
+		defer release()
+		c.Map(found)
+		c.Next()
 	})
 
 	// map json encoder
@@ -34,78 +48,152 @@ func RunWeb(ip string, port int, monitors map[string]interface{}) {
 		w.Header().Set("Content-Type", "application/json")
 	})
 
-	route.Get("/dirs", func(enc encoder.Encoder, req *http.Request) (int, []byte) {
+	route.Get("/dirs", func(enc encoder.Encoder, req *http.Request, m *index.Monitor) (int, []byte) {
 		defer func() {
 			if err := recover(); err != nil {
 				fmt.Println(err)
 			}
 		}()
-		monitored := req.Header.Get("MONITORED")
-		lastIndexed, _ := strconv.Atoi(req.FormValue("last_indexed"))
-		result := make([]index.IndexedFile, 0)
-
-		db, _ := sql.Open("sqlite3", index.SlashSuffix(monitored)+".sync/index.db")
-		defer db.Close()
-		psSelectDirs, _ := db.Prepare("SELECT * FROM FILES WHERE FILE_SIZE=-1 AND LAST_INDEXED>?")
-		defer psSelectDirs.Close()
-		rows, _ := psSelectDirs.Query(lastIndexed)
-		defer rows.Close()
-		for rows.Next() {
-			file := new(index.IndexedFile)
-			rows.Scan(&file.FilePath, &file.LastModified, &file.FileSize, &file.FileMode, &file.Status, &file.LastIndexed)
-			result = append(result, *file)
+		lastIndexed, _ := strconv.ParseInt(req.FormValue("last_indexed"), 10, 64)
+
+		result, err := m.Store.ChangedDirs(lastIndexed)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+		return http.StatusOK, encoder.Must(enc.Encode(result))
+	})
+
+	route.Get("/files", func(enc encoder.Encoder, req *http.Request, m *index.Monitor) (int, []byte) {
+		lastIndexed, _ := strconv.ParseInt(req.FormValue("last_indexed"), 10, 64)
+		filePath := index.SlashSuffix(req.FormValue("file_path"))
+
+		result, err := m.Store.ChangedFiles(lastIndexed, filePath)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
 		}
 		return http.StatusOK, encoder.Must(enc.Encode(result))
 	})
 
-	route.Get("/files", func(enc encoder.Encoder, req *http.Request) (int, []byte) {
-		monitored := req.Header.Get("MONITORED")
-		lastIndexed, _ := strconv.Atoi(req.FormValue("last_indexed"))
-		filePath := index.SlashSuffix(index.LikeSafe(req.FormValue("file_path")))
-		result := make([]index.IndexedFile, 0)
-
-		db, _ := sql.Open("sqlite3", index.SlashSuffix(monitored)+".sync/index.db")
-		defer db.Close()
-		psSelectFiles, _ := db.Prepare(`SELECT * FROM FILES
-				WHERE LAST_INDEXED>? AND FILE_SIZE>=0 AND STATUS!='updating' AND FILE_PATH LIKE ?`)
-		defer psSelectFiles.Close()
-		rows, _ := psSelectFiles.Query(lastIndexed, filePath+"%")
-		defer rows.Close()
-		for rows.Next() {
-			file := new(index.IndexedFile)
-			rows.Scan(&file.FilePath, &file.LastModified, &file.FileSize, &file.FileMode, &file.Status, &file.LastIndexed)
-			result = append(result, *file)
+	route.Get("/file_parts", func(enc encoder.Encoder, req *http.Request, m *index.Monitor) (int, []byte) {
+		filePath := req.FormValue("file_path")
+
+		result, err := m.Store.FileParts(filePath)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
 		}
 		return http.StatusOK, encoder.Must(enc.Encode(result))
 	})
 
-	route.Get("/file_parts", func(enc encoder.Encoder, req *http.Request) (int, []byte) {
-		monitored := req.Header.Get("MONITORED")
+	route.Get("/versions", func(enc encoder.Encoder, req *http.Request, m *index.Monitor) (int, []byte) {
 		filePath := req.FormValue("file_path")
-		result := make([]index.IndexedFilePart, 0)
-
-		db, _ := sql.Open("sqlite3", index.SlashSuffix(monitored)+".sync/index.db")
-		defer db.Close()
-		psSelectFiles, _ := db.Prepare(`SELECT * FROM FILE_PARTS
-				WHERE FILE_PATH=? ORDER BY FILE_PATH,SEQ`)
-		defer psSelectFiles.Close()
-		rows, _ := psSelectFiles.Query(filePath)
-		defer rows.Close()
-		for rows.Next() {
-			filePart := new(index.IndexedFilePart)
-			rows.Scan(&filePart.FilePath, &filePart.Seq, &filePart.StartIndex, &filePart.Offset, &filePart.Checksum, &filePart.ChecksumType)
-			result = append(result, *filePart)
+
+		result, err := m.Store.Versions(filePath)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
 		}
 		return http.StatusOK, encoder.Must(enc.Encode(result))
 	})
 
-	route.Get("/download", func(res http.ResponseWriter, req *http.Request) {
-		monitored := req.Header.Get("MONITORED")
+	// the versions of a file, or of everything under a directory, as they
+	// were at the unix time at
+	route.Get("/snapshot", func(enc encoder.Encoder, req *http.Request, m *index.Monitor) (int, []byte) {
+		filePath := req.FormValue("file_path")
+		at, _ := strconv.ParseInt(req.FormValue("at"), 10, 64)
+
+		versions, err := m.Store.VersionsAt(filePath, at)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+		result := make([]index.FileVersion, 0, len(versions))
+		for _, version := range versions {
+			if version.FilePath == filePath || strings.HasPrefix(version.FilePath, index.SlashSuffix(filePath)) {
+				result = append(result, version)
+			}
+		}
+		return http.StatusOK, encoder.Must(enc.Encode(result))
+	})
+
+	// the latest generation, the versions it consists of are listed by
+	// /snapshot with at set to its Time
+	route.Get("/generation", func(enc encoder.Encoder, req *http.Request, m *index.Monitor) (int, []byte) {
+		if m.History == nil {
+			return http.StatusNotFound, []byte("No history is kept.")
+		}
+		result, err := m.Store.Generation()
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+		return http.StatusOK, encoder.Must(enc.Encode(result))
+	})
+
+	// the depth and counters of the indexing queue
+	route.Get("/metrics", func(enc encoder.Encoder, req *http.Request, m *index.Monitor) (int, []byte) {
+		result := m.QueueStats()
+		return http.StatusOK, encoder.Must(enc.Encode(result))
+	})
+
+	route.Get("/download_version", func(res http.ResponseWriter, req *http.Request, m *index.Monitor) {
+		filePath := req.FormValue("file_path")
+		versionTime, _ := strconv.ParseInt(req.FormValue("version"), 10, 64)
+
+		if m.Blocks == nil {
+			http.Error(res, "No history is kept.", http.StatusNotFound)
+			return
+		}
+		parts, err := m.Store.VersionParts(filePath, versionTime)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// check every block first, a missing one can't be reported once the
+		// content is being sent
+		var length int64
+		for _, part := range parts {
+			if part.ChecksumType == index.HOLE {
+				length += int64(part.Offset)
+				continue
+			}
+			if _, err := os.Stat(m.Blocks.Path(part.StrongChecksum)); err != nil {
+				http.Error(res, err.Error(), http.StatusNotFound)
+				return
+			}
+			length += int64(part.Offset)
+		}
+		res.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		res.Header().Set("Content-Type", "application/octet-stream")
+		for _, part := range parts {
+			if part.ChecksumType == index.HOLE {
+				res.Write(make([]byte, part.Offset))
+				continue
+			}
+			block, err := m.Blocks.Open(part.StrongChecksum)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			io.CopyN(res, block, int64(part.Offset))
+			block.Close()
+		}
+	})
+
+	route.Get("/download", func(res http.ResponseWriter, req *http.Request, m *index.Monitor) {
 		filePath := req.FormValue("file_path")
 		start, _ := strconv.ParseInt(req.FormValue("start"), 10, 64)
 		length, _ := strconv.ParseInt(req.FormValue("length"), 10, 64)
 
-		file, _ := os.Open(index.SlashSuffix(monitored) + filePath)
+		// a block asked for by hash is served from the block store when the
+		// monitor keeps one, it can't change while being read
+		if blocks := m.Blocks; blocks != nil && req.FormValue("hash") != "" {
+			if block, err := blocks.Open(req.FormValue("hash")); err == nil {
+				defer block.Close()
+				n, _ := io.CopyN(res, block, length)
+				res.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+				res.Header().Set("Content-Type", "application/octet-stream")
+				return
+			}
+		}
+
+		file, _ := os.Open(index.SlashSuffix(m.Monitored) + filePath)
 		defer file.Close()
 		file.Seek(start, os.SEEK_SET)
 		n, _ := io.CopyN(res, file, length)
@@ -114,5 +202,5 @@ func RunWeb(ip string, port int, monitors map[string]interface{}) {
 	})
 
 	m.Action(route.Handle)
-	fmt.Println(http.ListenAndServe(fmt.Sprint(ip, ":", port), m))
+	return m
 }
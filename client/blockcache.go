@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BLOCK_CACHE_SIZE caps the number of blocks remembered by a BlockCache.
+const BLOCK_CACHE_SIZE = 1 << 20
+
+// BlockCache maps the sha256 of blocks held in local files to where they
+// are, so a block the client already has in any file, a copy, an older
+// version or a sibling, is copied locally instead of downloaded. Entries are
+// verified before use, files changing underneath only cost a download. One
+// cache can be shared by the syncers of several monitors, a nil cache
+// remembers nothing.
+type BlockCache struct {
+	mu     sync.Mutex
+	blocks map[string]blockLocation
+	seeded map[string]bool // the directories Seed read
+}
+
+type blockLocation struct {
+	path   string
+	offset int64
+	length int64
+}
+
+func NewBlockCache() *BlockCache {
+	return &BlockCache{blocks: make(map[string]blockLocation), seeded: make(map[string]bool)}
+}
+
+// Seed records the blocks of the files under dir, so the local copies that
+// were there before the cache was made are reused as well. A directory is
+// read once per cache, Seed returns early once ctx is done.
+func (cache *BlockCache) Seed(ctx context.Context, dir string) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	seeded := cache.seeded[dir]
+	cache.seeded[dir] = true
+	cache.mu.Unlock()
+	if seeded {
+		return
+	}
+	started := time.Now()
+	blocks := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && info.Mode().IsRegular() {
+			blocks += cache.seedFile(path)
+		}
+		return nil
+	})
+	if ctx.Err() == nil {
+		fmt.Println("Found", blocks, "local blocks in", dir, "in", time.Since(started))
+	}
+}
+
+// seedFile records the blocks of the file at path the cache doesn't know
+// yet, at the offsets the server splits files at, and returns their number.
+func (cache *BlockCache) seedFile(path string) int {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer in.Close()
+	buf := make([]byte, index.BLOCK_SIZE)
+	added := 0
+	for offset := int64(0); ; offset += index.BLOCK_SIZE {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			strongHash := hex.EncodeToString(sum[:])
+			cache.mu.Lock()
+			_, known := cache.blocks[strongHash]
+			cache.mu.Unlock()
+			if !known {
+				cache.add(strongHash, path, offset, int64(n))
+				added++
+			}
+		}
+		if err != nil {
+			return added
+		}
+	}
+}
+
+// add records that path holds the block with strongHash at offset.
+func (cache *BlockCache) add(strongHash string, path string, offset int64, length int64) {
+	if cache == nil || strongHash == "" {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, ok := cache.blocks[strongHash]; !ok && len(cache.blocks) >= BLOCK_CACHE_SIZE {
+		for k := range cache.blocks {
+			delete(cache.blocks, k)
+			break
+		}
+	}
+	cache.blocks[strongHash] = blockLocation{path, offset, length}
+}
+
+// copyTo writes the block with strongHash to out at offset if a local file
+// still holds it, and reports whether it did.
+func (cache *BlockCache) copyTo(strongHash string, out *os.File, offset int64, length int64) bool {
+	if cache == nil || strongHash == "" {
+		return false
+	}
+	cache.mu.Lock()
+	location, ok := cache.blocks[strongHash]
+	cache.mu.Unlock()
+	if !ok || location.length != length {
+		return false
+	}
+
+	buf := make([]byte, length)
+	in, err := os.Open(location.path)
+	if err == nil {
+		var n int
+		n, err = in.ReadAt(buf, location.offset)
+		in.Close()
+		if int64(n) == length {
+			err = nil
+		}
+	}
+	sum := sha256.Sum256(buf)
+	if err != nil || hex.EncodeToString(sum[:]) != strongHash {
+		// the file changed since, forget it
+		cache.mu.Lock()
+		if cache.blocks[strongHash] == location {
+			delete(cache.blocks, strongHash)
+		}
+		cache.mu.Unlock()
+		return false
+	}
+	_, err = out.WriteAt(buf, offset)
+	return err == nil
+}
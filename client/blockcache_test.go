@@ -0,0 +1,72 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/elgs/filesync/index"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func blockHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBlockCacheSeed(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, index.BLOCK_SIZE+10)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "old.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewBlockCache()
+	cache.Seed(context.Background(), dir)
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "new.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	// both the full block and the short last one are found
+	tail := content[index.BLOCK_SIZE:]
+	if !cache.copyTo(blockHash(tail), out, 0, int64(len(tail))) {
+		t.Fatal("the last block of a file on disk isn't found")
+	}
+	first := content[:index.BLOCK_SIZE]
+	if !cache.copyTo(blockHash(first), out, int64(len(tail)), index.BLOCK_SIZE) {
+		t.Fatal("the first block of a file on disk isn't found")
+	}
+	got, _ := os.ReadFile(out.Name())
+	if !bytes.Equal(got, append(append([]byte(nil), tail...), first...)) {
+		t.Fatal("the copied blocks differ")
+	}
+
+	// a block that isn't at a block boundary isn't known
+	if cache.copyTo(blockHash(content[1:11]), out, 0, 10) {
+		t.Fatal("a block at an odd offset was found")
+	}
+	// the file changing is noticed when the block is used
+	os.WriteFile(filepath.Join(dir, "sub", "old.bin"), []byte("changed"), 0644)
+	if cache.copyTo(blockHash(tail), out, 0, int64(len(tail))) {
+		t.Fatal("a block was copied from a changed file")
+	}
+}
+
+func TestBlockCacheNil(t *testing.T) {
+	var cache *BlockCache
+	cache.Seed(context.Background(), t.TempDir())
+	cache.add("hash", "path", 0, 1)
+	if cache.copyTo("hash", nil, 0, 1) {
+		t.Fatal("a nil cache copied a block")
+	}
+}
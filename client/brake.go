@@ -0,0 +1,198 @@
+package client
+
+import (
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BRAKE_CONFIRM is the file that confirms the deletes the brake of a
+// monitor is holding back, see BrakeConfirm.
+const BRAKE_CONFIRM = "confirm-deletes"
+
+// BRAKE_MIN_ENTRIES is how many entries a cycle has to delete before the
+// percentage of a DeleteBrake counts, so small shares can delete a file.
+const BRAKE_MIN_ENTRIES = 10
+
+// BRAKE_WINDOW is the default for how long the deletes a syncer applied
+// count against its brake.
+const BRAKE_WINDOW = time.Hour
+
+// DeleteBrake keeps a monitor from applying a sync cycle that, together
+// with the deletes applied within Window before it, deletes more than
+// Percent of its local entries, or more than Count of them. A zero limit is
+// not checked. The window catches deletes that reach the client in batches,
+// such as the ones the patrol of the server finds.
+type DeleteBrake struct {
+	Percent int
+	Count   int
+	// Window is BRAKE_WINDOW if zero.
+	Window time.Duration
+	// Exit makes the syncer stop with a *BrakeError instead of pausing the
+	// monitor, for supervisors that alert on it.
+	Exit bool
+}
+
+// BrakeError is returned by a syncer whose brake has Exit set when it
+// trips.
+type BrakeError struct {
+	Monitored string
+	Affected  int
+	Total     int
+}
+
+func (e *BrakeError) Error() string {
+	return fmt.Sprintf("%s would delete %d of %d entries", e.Monitored, e.Affected, e.Total)
+}
+
+// check returns how many of the local entries the deletes would remove, and
+// how many local entries there are, and whether together with the deletes
+// applied recently that is too many. Recent deletes count towards the total
+// as well.
+func (brake DeleteBrake) check(deletes []string, recent int, local *localCount, now time.Time) (int, int, bool) {
+	if len(deletes) == 0 || (brake.Percent <= 0 && brake.Count <= 0) {
+		return 0, 0, false
+	}
+	affected := 0
+	for _, thePath := range outermost(deletes) {
+		affected += countEntries(thePath)
+	}
+	total := local.total(now, brake.window())
+	return affected, total, brake.tooMany(affected+recent, total+recent)
+}
+
+// outermost returns the paths that don't lie under another one of paths,
+// the entries under them are counted with them.
+func outermost(paths []string) []string {
+	set := make(map[string]bool, len(paths))
+	for _, thePath := range paths {
+		set[thePath] = true
+	}
+	result := make([]string, 0, len(paths))
+	for _, thePath := range paths {
+		under := false
+		for dir := filepath.Dir(thePath); !under && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			under = set[dir]
+		}
+		if !under {
+			result = append(result, thePath)
+		}
+	}
+	return result
+}
+
+// localCount is the number of entries of a monitored directory, but its
+// trash. A share is walked at most once per brake window to count them, the
+// deletes the syncer applies in between are taken off.
+type localCount struct {
+	monitored string
+	counted   time.Time
+	entries   int
+}
+
+// total returns the entries, counted again if the count is older than
+// window.
+func (c *localCount) total(now time.Time, window time.Duration) int {
+	if c.counted.IsZero() || now.Sub(c.counted) > window {
+		c.entries = countEntries(c.monitored) - countEntries(filepath.Join(c.monitored, TRASH_DIR)) - 1
+		c.counted = now
+	}
+	return c.entries
+}
+
+// deleted takes entries deleted by the syncer off the count.
+func (c *localCount) deleted(entries int) {
+	c.entries -= entries
+}
+
+// window returns the Window of brake.
+func (brake DeleteBrake) window() time.Duration {
+	if brake.Window <= 0 {
+		return BRAKE_WINDOW
+	}
+	return brake.Window
+}
+
+// deleteWindow remembers how many entries a syncer deleted when, so the
+// deletes of the cycles within the window of its brake add up.
+type deleteWindow struct {
+	applied []appliedDeletes
+}
+
+type appliedDeletes struct {
+	at      time.Time
+	entries int
+}
+
+// count returns the entries deleted within window before now.
+func (w *deleteWindow) count(now time.Time, window time.Duration) int {
+	for len(w.applied) > 0 && now.Sub(w.applied[0].at) > window {
+		w.applied = w.applied[1:]
+	}
+	count := 0
+	for _, applied := range w.applied {
+		count += applied.entries
+	}
+	return count
+}
+
+// add records that entries were deleted at now.
+func (w *deleteWindow) add(now time.Time, entries int) {
+	if entries > 0 {
+		w.applied = append(w.applied, appliedDeletes{now, entries})
+	}
+}
+
+// reset forgets the deletes, once a user confirmed them.
+func (w *deleteWindow) reset() {
+	w.applied = nil
+}
+
+// tooMany reports whether deleting affected of total entries trips brake.
+func (brake DeleteBrake) tooMany(affected int, total int) bool {
+	if brake.Count > 0 && affected > brake.Count {
+		return true
+	}
+	return brake.Percent > 0 && affected > BRAKE_MIN_ENTRIES && affected*100 > total*brake.Percent
+}
+
+// countEntries returns the number of files and directories at and below
+// thePath.
+func countEntries(thePath string) int {
+	count := 0
+	filepath.Walk(thePath, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// BrakeConfirm returns where BRAKE_CONFIRM is kept for monitored: in its
+// trash, or next to its generations for a snapshot monitor. Creating it
+// confirms the deletes held back, the syncer applies them in its next cycle.
+func BrakeConfirm(monitored string) string {
+	if info, err := os.Stat(GenerationsDir(monitored)); err == nil && info.IsDir() {
+		return filepath.Join(GenerationsDir(monitored), BRAKE_CONFIRM)
+	}
+	return filepath.Join(monitored, TRASH_DIR, BRAKE_CONFIRM)
+}
+
+// localDeletes returns the local paths of the entries the server reports as
+// deleted that still exist here.
+func localDeletes(monitored string, entries []index.IndexedFile) []string {
+	result := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Status != "deleted" || InTrash(entry.FilePath) {
+			continue
+		}
+		thePath := filepath.Join(monitored, filepath.FromSlash(entry.FilePath))
+		if _, err := os.Lstat(thePath); err == nil {
+			result = append(result, thePath)
+		}
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeleteBrakeWindow(t *testing.T) {
+	monitored := t.TempDir()
+	for i := 0; i < 100; i++ {
+		os.WriteFile(filepath.Join(monitored, fmt.Sprintf("%d.txt", i)), []byte("a"), 0644)
+	}
+	brake := DeleteBrake{Percent: 20, Count: 1000}
+	batch := func(from int) []string {
+		deletes := make([]string, 0)
+		for i := from; i < from+8; i++ {
+			deletes = append(deletes, filepath.Join(monitored, fmt.Sprintf("%d.txt", i)))
+		}
+		return deletes
+	}
+
+	// batches under the limit each add up within the window
+	var window deleteWindow
+	local := &localCount{monitored: monitored}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		now := start.Add(time.Duration(i) * time.Minute)
+		recent := window.count(now, brake.window())
+		affected, _, tripped := brake.check(batch(i*8), recent, local, now)
+		if tripped {
+			t.Fatalf("batch %d tripped the brake with %d recent deletes", i, recent)
+		}
+		window.add(now, affected)
+		local.deleted(affected)
+		for _, thePath := range batch(i * 8) {
+			os.Remove(thePath)
+		}
+	}
+	now := start.Add(2 * time.Minute)
+	recent := window.count(now, brake.window())
+	if recent != 16 {
+		t.Fatalf("%d recent deletes, want 16", recent)
+	}
+	if _, _, tripped := brake.check(batch(16), recent, local, now); !tripped {
+		t.Fatal("a third batch within the window didn't trip the brake")
+	}
+
+	// once the window passed, the batches are forgotten
+	later := start.Add(2*time.Minute + brake.window())
+	if recent := window.count(later, brake.window()); recent != 0 {
+		t.Fatalf("%d deletes are left after the window", recent)
+	}
+	if _, _, tripped := brake.check(batch(16), 0, local, later); tripped {
+		t.Fatal("a single batch tripped the brake")
+	}
+}
+
+func TestDeleteBrakeNested(t *testing.T) {
+	monitored := t.TempDir()
+	for i := 0; i < 200; i++ {
+		os.WriteFile(filepath.Join(monitored, fmt.Sprintf("%d.txt", i)), []byte("a"), 0644)
+	}
+	dir := filepath.Join(monitored, "d")
+	os.Mkdir(dir, 0755)
+	// the server reports the directory and every entry in it as deleted
+	deletes := []string{dir}
+	for i := 0; i < 30; i++ {
+		thePath := filepath.Join(dir, fmt.Sprintf("%d.txt", i))
+		os.WriteFile(thePath, []byte("a"), 0644)
+		deletes = append(deletes, thePath)
+	}
+	brake := DeleteBrake{Percent: 20, Count: 1000}
+	affected, total, tripped := brake.check(deletes, 0, &localCount{monitored: monitored}, time.Now())
+	if affected != 31 || total != 231 {
+		t.Fatalf("%d of %d entries affected, want 31 of 231", affected, total)
+	}
+	if tripped {
+		t.Fatal("the brake tripped on 13% of the entries")
+	}
+}
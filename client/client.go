@@ -0,0 +1,172 @@
+// Package client syncs directories from a gsyncd server. A Client speaks the
+// api of the server, a Syncer keeps a local directory in line with a monitor
+// and a SnapshotSyncer does the same a whole generation at a time.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Client requests the index and the content of one monitor from a server.
+type Client struct {
+	// BaseURL is where the server is, such as http://127.0.0.1:6776.
+	BaseURL string
+	// Key is the key of the monitor on the server.
+	Key string
+	// HTTPClient makes the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the monitor key served at ip and port.
+func New(ip string, port int, key string) *Client {
+	return &Client{BaseURL: fmt.Sprint("http://", ip, ":", port), Key: key}
+}
+
+// StatusError is returned when the server answers with a status other than
+// 200 OK, such as 401 for an unknown key.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
+// Dirs returns the directories indexed after lastIndexed, deleted ones
+// included.
+func (c *Client) Dirs(ctx context.Context, lastIndexed int64) ([]index.IndexedFile, error) {
+	var dirs []index.IndexedFile
+	err := c.getJSON(ctx, "/dirs", url.Values{"last_indexed": {fmt.Sprint(lastIndexed)}}, &dirs)
+	return dirs, err
+}
+
+// Files returns the files under the directory filePath indexed after
+// lastIndexed, deleted ones included.
+func (c *Client) Files(ctx context.Context, filePath string, lastIndexed int64) ([]index.IndexedFile, error) {
+	var files []index.IndexedFile
+	err := c.getJSON(ctx, "/files", url.Values{"last_indexed": {fmt.Sprint(lastIndexed)}, "file_path": {filePath}}, &files)
+	return files, err
+}
+
+// FileParts returns the parts of the file filePath, in order.
+func (c *Client) FileParts(ctx context.Context, filePath string) ([]index.IndexedFilePart, error) {
+	var parts []index.IndexedFilePart
+	err := c.getJSON(ctx, "/file_parts", url.Values{"file_path": {filePath}}, &parts)
+	return parts, err
+}
+
+// Versions returns the versions the server keeps of filePath, the newest
+// first.
+func (c *Client) Versions(ctx context.Context, filePath string) ([]index.FileVersion, error) {
+	var versions []index.FileVersion
+	err := c.getJSON(ctx, "/versions", url.Values{"file_path": {filePath}}, &versions)
+	return versions, err
+}
+
+// Snapshot returns the versions of filePath, or of everything under it for
+// a directory, as they were at the unix time at.
+func (c *Client) Snapshot(ctx context.Context, filePath string, at int64) ([]index.FileVersion, error) {
+	var versions []index.FileVersion
+	err := c.getJSON(ctx, "/snapshot", url.Values{"file_path": {filePath}, "at": {fmt.Sprint(at)}}, &versions)
+	return versions, err
+}
+
+// Generation returns the latest generation of the monitor.
+func (c *Client) Generation(ctx context.Context) (index.Generation, error) {
+	var generation index.Generation
+	err := c.getJSON(ctx, "/generation", nil, &generation)
+	return generation, err
+}
+
+// Metrics returns the state of the indexing queue of the monitor.
+func (c *Client) Metrics(ctx context.Context) (index.QueueStats, error) {
+	var stats index.QueueStats
+	err := c.getJSON(ctx, "/metrics", nil, &stats)
+	return stats, err
+}
+
+// Download returns length bytes of filePath from start on. With hash set
+// the server may serve the block from its block store. The caller closes
+// the reader.
+func (c *Client) Download(ctx context.Context, filePath string, start int64, length int64, hash string) (io.ReadCloser, error) {
+	resp, err := c.get(ctx, "/download", url.Values{
+		"file_path": {filePath},
+		"start":     {fmt.Sprint(start)},
+		"length":    {fmt.Sprint(length)},
+		"hash":      {hash},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DownloadTo writes length bytes of filePath from start on to out at start,
+// and returns the number of bytes written.
+func (c *Client) DownloadTo(ctx context.Context, filePath string, start int64, length int64, hash string, out io.WriterAt) (int64, error) {
+	body, err := c.Download(ctx, filePath, start, length, hash)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.CopyN(io.NewOffsetWriter(out, start), body, length)
+	if err == io.EOF {
+		err = fmt.Errorf("got %d of %d bytes of %s", n, length, filePath)
+	}
+	return n, err
+}
+
+// DownloadVersion returns the content of filePath as it was at versionTime,
+// and its length. It needs a server that keeps history.
+func (c *Client) DownloadVersion(ctx context.Context, filePath string, versionTime int64) (io.ReadCloser, int64, error) {
+	resp, err := c.get(ctx, "/download_version", url.Values{"file_path": {filePath}, "version": {fmt.Sprint(versionTime)}})
+	if err != nil {
+		return nil, 0, err
+	}
+	length, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return resp.Body, length, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("AUTH_KEY", c.Key)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, &StatusError{resp.StatusCode, resp.Status, string(body)}
+	}
+	return resp, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := c.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SYNC_TEMP_PREFIX names the file next to a copy that fileSync writes the
+// new copy into, <dir>/.gsync-sync-<name>.
+const SYNC_TEMP_PREFIX = ".gsync-sync-"
+
+// The states fileSync takes the local copy of a file through.
+const (
+	SYNC_STAT     = iota // look for the local copy
+	SYNC_PARTS           // fetch the parts of the server's record
+	SYNC_COMPARE         // compare the blocks of a copy of the server's size with the parts
+	SYNC_OPEN            // open the copy if there is one, and the new one
+	SYNC_DOWNLOAD        // the server has no parts, download the file as a whole
+	SYNC_SIZE            // make the new copy the server's size
+	SYNC_BLOCK           // take the next part from the copy, or fetch it
+	SYNC_RENAME          // replace the copy by the new one, or close the one written in place
+	SYNC_DONE
+)
+
+// syncSource is where fileSync gets the server's side of a file from.
+type syncSource interface {
+	// parts returns the parts of the file, in order.
+	parts() ([]index.IndexedFilePart, error)
+	// block writes the content of part to out.
+	block(part index.IndexedFilePart, out *os.File) error
+	// whole writes the first size bytes of the file to out.
+	whole(size int64, out *os.File) error
+}
+
+// fileSync brings the local copy of a file in line with the server's record
+// of it, one state at a time. The new copy is written next to the old one
+// and renamed over it once complete, so a sync cut short leaves the old
+// copy, which is synced again. A copy whose blocks all match the parts is
+// left as it is, whatever its mtime. Otherwise the parts the old copy holds
+// already are taken from it, only the others are fetched. Holes are left
+// unwritten. An empty file has no parts, its copy is only created empty.
+//
+// The copy of a file with hard links is written in place instead, so the
+// local links to it keep sharing its content. A sync of it cut short leaves
+// a mix of old and new blocks, which the next sync completes.
+type fileSync struct {
+	path   string
+	size   int64
+	source syncSource
+	cache  *BlockCache
+	// linked writes an existing copy in place
+	linked   bool
+	state    int
+	created  bool
+	sameSize bool     // the copy there is has the server's size
+	old      *os.File // the copy there is, nil if created
+	out      *os.File // the new copy, old itself if written in place
+	parts    []index.IndexedFilePart
+	next     int // the part SYNC_BLOCK looks at
+}
+
+// run steps through the states until the copy is done. It reports whether
+// the copy was written.
+func (s *fileSync) run() (bool, error) {
+	defer func() {
+		if s.old != nil && s.old != s.out {
+			s.old.Close()
+		}
+		if s.out != nil {
+			// only left if the sync failed
+			s.out.Close()
+			if !s.inPlace() {
+				os.Remove(s.out.Name())
+			}
+		}
+	}()
+	changed := false
+	for s.state != SYNC_DONE {
+		if s.state >= SYNC_OPEN {
+			changed = true
+		}
+		if err := s.step(); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+func (s *fileSync) step() error {
+	switch s.state {
+	case SYNC_STAT:
+		info, err := os.Stat(s.path)
+		if os.IsNotExist(err) {
+			s.created = true
+		} else if err != nil {
+			return err
+		}
+		s.sameSize = !s.created && info.Size() == s.size
+		s.state = SYNC_PARTS
+	case SYNC_PARTS:
+		var err error
+		if s.parts, err = s.source.parts(); err != nil {
+			return err
+		}
+		// a copy of another size differs, and one without parts to compare
+		// with is downloaded
+		s.state = SYNC_OPEN
+		if s.sameSize && (len(s.parts) > 0 || s.size == 0) {
+			s.state = SYNC_COMPARE
+		}
+	case SYNC_COMPARE:
+		if err := s.openOld(); err != nil {
+			return err
+		}
+		s.state = SYNC_DONE
+		for _, part := range s.parts {
+			if same, err := s.holds(part); err != nil || !same {
+				s.state = SYNC_OPEN
+				return err
+			}
+		}
+	case SYNC_OPEN:
+		if s.linked && !s.created {
+			out, err := os.OpenFile(s.path, os.O_RDWR, 0)
+			if err != nil {
+				return err
+			}
+			if s.old != nil {
+				s.old.Close()
+			}
+			s.old, s.out = out, out
+			s.state = SYNC_SIZE
+			if len(s.parts) == 0 && s.size > 0 {
+				s.state = SYNC_DOWNLOAD
+			}
+			return nil
+		}
+		mode := os.FileMode(0666)
+		if !s.created {
+			if err := s.openOld(); err != nil {
+				return err
+			}
+			if info, err := s.old.Stat(); err == nil {
+				mode = info.Mode().Perm()
+			}
+		}
+		tmp := filepath.Join(filepath.Dir(s.path), SYNC_TEMP_PREFIX+filepath.Base(s.path))
+		out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		s.out = out
+		if !s.created {
+			// the umask doesn't apply to the mode the copy had
+			out.Chmod(mode)
+		}
+		s.state = SYNC_SIZE
+		if len(s.parts) == 0 && s.size > 0 {
+			s.state = SYNC_DOWNLOAD
+		}
+	case SYNC_DOWNLOAD:
+		if err := s.source.whole(s.size, s.out); err != nil {
+			return err
+		}
+		if err := s.out.Truncate(s.size); err != nil {
+			return err
+		}
+		s.state = SYNC_RENAME
+	case SYNC_SIZE:
+		// the new copy is a hole of the server's size that the parts fill,
+		// a copy written in place keeps its blocks up to that size
+		if err := s.out.Truncate(s.size); err != nil {
+			return err
+		}
+		s.state = SYNC_BLOCK
+	case SYNC_BLOCK:
+		if s.next >= len(s.parts) {
+			s.state = SYNC_RENAME
+			return nil
+		}
+		part := s.parts[s.next]
+		s.next++
+		if part.Offset == 0 || part.ChecksumType == index.HOLE && !s.inPlace() {
+			// the empty part indexes used to give empty files, and a hole
+			// on the server, there are no zeros to write
+			return nil
+		}
+		if s.old != nil {
+			same, err := s.copyUnchanged(part)
+			if err != nil || same {
+				return err
+			}
+		}
+		if part.ChecksumType == index.HOLE {
+			// over blocks of the copy written in place
+			_, err := s.out.WriteAt(make([]byte, part.Offset), part.StartIndex)
+			return err
+		}
+		if err := s.source.block(part, s.out); err != nil {
+			return err
+		}
+		s.cache.add(part.StrongChecksum, s.path, part.StartIndex, int64(part.Offset))
+	case SYNC_RENAME:
+		if err := s.out.Close(); err != nil {
+			return err
+		}
+		if s.inPlace() {
+			s.old, s.out = nil, nil
+			s.state = SYNC_DONE
+			return nil
+		}
+		if err := os.Rename(s.out.Name(), s.path); err != nil {
+			os.Remove(s.out.Name())
+			s.out = nil
+			return err
+		}
+		s.out = nil
+		s.state = SYNC_DONE
+	}
+	return nil
+}
+
+// inPlace reports whether the copy is written in place.
+func (s *fileSync) inPlace() bool {
+	return s.out != nil && s.out == s.old
+}
+
+// openOld opens the copy there is, once.
+func (s *fileSync) openOld() error {
+	if s.old != nil {
+		return nil
+	}
+	old, err := os.Open(s.path)
+	s.old = old
+	return err
+}
+
+// readOld returns the content of part in the old copy if it holds the part,
+// nil if it doesn't.
+func (s *fileSync) readOld(part index.IndexedFilePart) ([]byte, error) {
+	buf := make([]byte, part.Offset)
+	n, err := s.old.ReadAt(buf, part.StartIndex)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n != len(buf) || fmt.Sprint(crc32.ChecksumIEEE(buf)) != part.Checksum {
+		return nil, nil
+	}
+	return buf, nil
+}
+
+// holds reports whether the old copy holds part.
+func (s *fileSync) holds(part index.IndexedFilePart) (bool, error) {
+	buf, err := s.readOld(part)
+	return buf != nil, err
+}
+
+// copyUnchanged copies part from the old copy to the new one if the old
+// copy holds it already, and reports whether it did.
+func (s *fileSync) copyUnchanged(part index.IndexedFilePart) (bool, error) {
+	buf, err := s.readOld(part)
+	if err != nil || buf == nil {
+		return false, err
+	}
+	if s.inPlace() {
+		return true, nil
+	}
+	if _, err := s.out.WriteAt(buf, part.StartIndex); err != nil {
+		return false, err
+	}
+	s.cache.add(part.StrongChecksum, s.path, part.StartIndex, int64(part.Offset))
+	return true, nil
+}
+
+// SyncFile brings the local copy at thePath in line with the record file
+// of the server, fetching only the blocks that differ. Blocks found in
+// cache are copied from local files instead, cache may be nil. It reports
+// whether the copy was written, a copy whose blocks match the record is
+// left alone. The copy of a file with hard links is written in place.
+func (c *Client) SyncFile(ctx context.Context, file index.IndexedFile, thePath string, cache *BlockCache) (bool, error) {
+	s := &fileSync{
+		path:   thePath,
+		size:   file.FileSize,
+		source: serverFile{ctx, c, file.FilePath, cache},
+		cache:  cache,
+		linked: file.Links > 1,
+	}
+	return s.run()
+}
+
+// serverFile is the syncSource of filePath on the server.
+type serverFile struct {
+	ctx      context.Context
+	c        *Client
+	filePath string
+	cache    *BlockCache
+}
+
+func (f serverFile) parts() ([]index.IndexedFilePart, error) {
+	return f.c.FileParts(f.ctx, f.filePath)
+}
+
+// block copies part from a local file holding the same block if the cache
+// knows one, and downloads it otherwise.
+func (f serverFile) block(part index.IndexedFilePart, out *os.File) error {
+	length := int64(part.Offset)
+	if !f.cache.copyTo(part.StrongChecksum, out, part.StartIndex, length) {
+		if _, err := f.c.DownloadTo(f.ctx, f.filePath, part.StartIndex, length, part.StrongChecksum, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f serverFile) whole(size int64, out *os.File) error {
+	_, err := f.c.DownloadTo(f.ctx, f.filePath, 0, size, "", out)
+	return err
+}
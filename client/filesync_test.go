@@ -0,0 +1,240 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeSource serves content as the server's side of a file, in parts of
+// BLOCK_SIZE, and records which parts were fetched.
+type fakeSource struct {
+	content []byte
+	noParts bool
+	// holes are the parts served as HOLE, their content has to be zeros
+	holes map[int]bool
+	// failAt makes fetching that part fail, -1 fails none
+	failAt  int
+	fetched []int
+	wholes  int
+}
+
+func (f *fakeSource) parts() ([]index.IndexedFilePart, error) {
+	parts := make([]index.IndexedFilePart, 0)
+	if f.noParts {
+		return parts, nil
+	}
+	for seq := 0; int64(seq)*index.BLOCK_SIZE < int64(len(f.content)); seq++ {
+		start := int64(seq) * index.BLOCK_SIZE
+		end := start + index.BLOCK_SIZE
+		if end > int64(len(f.content)) {
+			end = int64(len(f.content))
+		}
+		b := f.content[start:end]
+		part := index.IndexedFilePart{
+			Seq:            seq,
+			StartIndex:     start,
+			Offset:         len(b),
+			Checksum:       fmt.Sprint(crc32.ChecksumIEEE(b)),
+			ChecksumType:   "CRC32",
+			StrongChecksum: blockHash(b),
+		}
+		if f.holes[seq] {
+			part.ChecksumType, part.StrongChecksum = index.HOLE, ""
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func (f *fakeSource) block(part index.IndexedFilePart, out *os.File) error {
+	if part.Seq == f.failAt {
+		return errors.New("connection lost")
+	}
+	f.fetched = append(f.fetched, part.Seq)
+	_, err := out.WriteAt(f.content[part.StartIndex:part.StartIndex+int64(part.Offset)], part.StartIndex)
+	return err
+}
+
+func (f *fakeSource) whole(size int64, out *os.File) error {
+	f.wholes++
+	_, err := out.WriteAt(f.content[:size], 0)
+	return err
+}
+
+// filled returns n bytes of fill.
+func filled(n int64, fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, int(n))
+}
+
+func TestFileSyncCutShort(t *testing.T) {
+	thePath := filepath.Join(t.TempDir(), "f.bin")
+	old := append(filled(index.BLOCK_SIZE, 'a'), filled(index.BLOCK_SIZE, 'b')...)
+	if err := os.WriteFile(thePath, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// changed on the server since, at the same size, the last block fails
+	// after the first was fetched
+	content := append(filled(index.BLOCK_SIZE, 'x'), filled(index.BLOCK_SIZE, 'y')...)
+	source := &fakeSource{content: content, failAt: 1}
+	s := &fileSync{path: thePath, size: int64(len(content)), source: source}
+	if _, err := s.run(); err == nil {
+		t.Fatal("a failed block wasn't reported")
+	}
+	if got, _ := os.ReadFile(thePath); !bytes.Equal(got, old) {
+		t.Fatal("the copy was changed by a sync cut short")
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(thePath), SYNC_TEMP_PREFIX+"*"))
+	if len(matches) != 0 {
+		t.Fatalf("%v left behind", matches)
+	}
+
+	// the next sync completes it
+	source.failAt = -1
+	s = &fileSync{path: thePath, size: int64(len(content)), source: source}
+	if _, err := s.run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(thePath); !bytes.Equal(got, content) {
+		t.Fatal("the copy wasn't synced")
+	}
+	if info, _ := os.Stat(thePath); info.Mode().Perm() != 0644 {
+		t.Errorf("the mode of the copy became %v", info.Mode().Perm())
+	}
+}
+
+func TestFileSync(t *testing.T) {
+	block := index.BLOCK_SIZE
+	base := append(append(filled(block, 'a'), filled(block, 'b')...), filled(block/2, 'c')...)
+	middle := append([]byte(nil), base...)
+	middle[block+5] = 'x'
+	last := append([]byte(nil), base...)
+	last[len(last)-1] = 'x'
+	grown := append(append([]byte(nil), base...), filled(block, 'd')...)
+	cases := []struct {
+		name   string
+		local  []byte // nil if there is no copy
+		server []byte
+		// noParts has the server send the file as a whole
+		noParts bool
+		fetched []int
+		wholes  int
+	}{
+		{"empty new", nil, []byte{}, false, nil, 0},
+		{"empty existing", base, []byte{}, false, nil, 0},
+		{"new", nil, base, false, []int{0, 1, 2}, 0},
+		{"shrink", base, base[:block+10], false, nil, 0},
+		{"shrink at a block", base, base[:block], false, nil, 0},
+		{"growth", base, grown, false, []int{2, 3}, 0},
+		{"changed middle block", base, middle, false, []int{1}, 0},
+		{"changed last block", base, last, false, []int{2}, 0},
+		{"unchanged", base, base, false, nil, 0},
+		{"same size, local newer, content differs", middle, base, false, []int{1}, 0},
+		{"no parts", []byte("old"), []byte("new content"), true, nil, 1},
+	}
+	// the copies are newer than anything the server indexed, which doesn't
+	// make them synced
+	newer := time.Now().Add(time.Hour)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			thePath := filepath.Join(t.TempDir(), "f.bin")
+			var before os.FileInfo
+			if c.local != nil {
+				if err := os.WriteFile(thePath, c.local, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(thePath, newer, newer); err != nil {
+					t.Fatal(err)
+				}
+				before, _ = os.Stat(thePath)
+			}
+			source := &fakeSource{content: c.server, noParts: c.noParts, failAt: -1}
+			s := &fileSync{path: thePath, size: int64(len(c.server)), source: source}
+			written, err := s.run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if same := c.local != nil && bytes.Equal(c.local, c.server); written == same {
+				t.Errorf("written is %v for a copy that is the same: %v", written, same)
+			} else if after, _ := os.Stat(thePath); same && !os.SameFile(before, after) {
+				t.Error("a copy that is the same was replaced")
+			}
+			if got, _ := os.ReadFile(thePath); !bytes.Equal(got, c.server) {
+				t.Fatalf("the copy has %d bytes that differ from the %d of the server", len(got), len(c.server))
+			}
+			if fmt.Sprint(source.fetched) != fmt.Sprint(c.fetched) || source.wholes != c.wholes {
+				t.Errorf("fetched parts %v and %d wholes, want %v and %d", source.fetched, source.wholes, c.fetched, c.wholes)
+			}
+		})
+	}
+}
+
+func TestFileSyncLinked(t *testing.T) {
+	dir := t.TempDir()
+	thePath, link := filepath.Join(dir, "a.bin"), filepath.Join(dir, "b.bin")
+	old := append(filled(index.BLOCK_SIZE, 'a'), filled(index.BLOCK_SIZE, 'b')...)
+	if err := os.WriteFile(thePath, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(thePath, link); err != nil {
+		t.Skip(err)
+	}
+	content := append(filled(index.BLOCK_SIZE, 'a'), filled(index.BLOCK_SIZE/2, 'x')...)
+	source := &fakeSource{content: content, failAt: -1}
+	s := &fileSync{path: thePath, size: int64(len(content)), source: source, linked: true}
+	if _, err := s.run(); err != nil {
+		t.Fatal(err)
+	}
+	// written in place, the link shares the new content
+	info, _ := os.Stat(thePath)
+	linkInfo, _ := os.Stat(link)
+	if !os.SameFile(info, linkInfo) {
+		t.Fatal("the copy was replaced, the link holds the old content")
+	}
+	if got, _ := os.ReadFile(link); !bytes.Equal(got, content) {
+		t.Fatal("the copy wasn't synced")
+	}
+	if fmt.Sprint(source.fetched) != "[1]" {
+		t.Errorf("fetched parts %v, want [1]", source.fetched)
+	}
+}
+
+func TestFileSyncHoles(t *testing.T) {
+	block := index.BLOCK_SIZE
+	content := append(append(filled(block, 'a'), filled(block, 0)...), filled(block/2, 'c')...)
+	for _, c := range []struct {
+		name   string
+		local  []byte
+		linked bool
+	}{
+		{"new", nil, false},
+		{"over data", filled(3*block, 'x'), false},
+		{"over data in place", filled(3*block, 'x'), true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			thePath := filepath.Join(t.TempDir(), "f.bin")
+			if c.local != nil {
+				if err := os.WriteFile(thePath, c.local, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			source := &fakeSource{content: content, holes: map[int]bool{1: true}, failAt: -1}
+			s := &fileSync{path: thePath, size: int64(len(content)), source: source, linked: c.linked}
+			if _, err := s.run(); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(thePath); !bytes.Equal(got, content) {
+				t.Fatal("the copy wasn't synced")
+			}
+			if fmt.Sprint(source.fetched) != "[0 2]" {
+				t.Errorf("fetched parts %v, the hole shouldn't be fetched", source.fetched)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RestoreVersion downloads version into target, replacing it only once the
+// whole content has arrived, with the mode and mtime of version. It needs a
+// server that keeps history.
+func (c *Client) RestoreVersion(ctx context.Context, version index.FileVersion, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.FileMode(0755)); err != nil {
+		return err
+	}
+	body, _, err := c.DownloadVersion(ctx, version.FilePath, version.VersionTime)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".gsync-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := copySparse(tmp, body)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if n != version.FileSize {
+		return fmt.Errorf("got %d of %d bytes", n, version.FileSize)
+	}
+	os.Chmod(tmp.Name(), version.FileMode)
+	modified := time.Unix(version.LastModified, 0)
+	os.Chtimes(tmp.Name(), modified, modified)
+	return os.Rename(tmp.Name(), target)
+}
@@ -0,0 +1,328 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GENERATIONS_SUFFIX names the directory next to a snapshot monitor that
+// holds its generations, <monitored>.gsync-generations/<seq>.
+const GENERATIONS_SUFFIX = ".gsync-generations"
+
+// SNAPSHOT_ORIGINAL is where, in the generations of a snapshot monitor, a
+// directory that was at the monitored path before snapshot mode is kept. It
+// is no generation, so it is never removed with them.
+const SNAPSHOT_ORIGINAL = "original"
+
+// GenerationsDir returns the directory holding the generations of monitored.
+func GenerationsDir(monitored string) string {
+	return strings.TrimSuffix(monitored, "/") + GENERATIONS_SUFFIX
+}
+
+// SnapshotSyncer keeps Monitored at the latest generation of the monitor of
+// Client. A generation is built in a staging directory next to Monitored,
+// which is a symlink to the current one, and the symlink is only replaced
+// once the generation is complete, so readers see either the old or the new
+// generation as a whole. Files already held are linked instead of being
+// downloaded again. The two newest generations are kept, processes still
+// reading the previous one can finish.
+type SnapshotSyncer struct {
+	Client    *Client
+	Monitored string
+	// MaxInterval caps the time between two looks at the server, which
+	// back off from a second while there is no new generation. It is
+	// MAX_INTERVAL if zero.
+	MaxInterval time.Duration
+	Brake       DeleteBrake
+}
+
+// Run syncs until ctx is done, or until a brake with Exit set trips.
+func (s *SnapshotSyncer) Run(ctx context.Context) error {
+	c, monitored := s.Client, s.Monitored
+	maxInterval := s.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = MAX_INTERVAL
+	}
+	generations := GenerationsDir(monitored)
+	if err := os.MkdirAll(generations, os.FileMode(0755)); err != nil {
+		return err
+	}
+	current, manifest := currentGeneration(generations)
+	// the latest generation looked at, newer than current if it had nothing
+	// new
+	seen := current
+	paused := false
+	var window deleteWindow
+	sleepTime := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleepTime):
+		}
+		sleepTime *= 2
+		if sleepTime >= maxInterval {
+			sleepTime = maxInterval
+		}
+
+		generation, err := c.Generation(ctx)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if generation.Seq <= seen {
+			continue
+		}
+		versions, err := c.Snapshot(ctx, "/", generation.Time)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if sameSnapshot(manifest, versions) && current > 0 {
+			// nothing changed since the generation we have
+			seen = generation.Seq
+			continue
+		}
+
+		confirm := BrakeConfirm(monitored)
+		removed := 0
+		for filePath := range manifest {
+			if !inSnapshot(versions, filePath) {
+				removed++
+			}
+		}
+		now := time.Now()
+		recent := window.count(now, s.Brake.window())
+		tripped := s.Brake.tooMany(removed+recent, len(manifest)+recent)
+		_, err = os.Lstat(confirm)
+		if tripped && err != nil {
+			if !paused {
+				paused = true
+				fmt.Printf("ALERT: generation %d of %s would delete %d of %d files, %d more within %v, confirm with gsync confirm-deletes %s\n",
+					generation.Seq, c.Key, removed, len(manifest), recent, s.Brake.window(), c.Key)
+				if s.Brake.Exit {
+					return &BrakeError{monitored, removed + recent, len(manifest) + recent}
+				}
+				fmt.Println("Paused", monitored, "until the deletes are confirmed or no longer reported")
+			}
+			continue
+		}
+		if tripped {
+			window.reset()
+		} else {
+			window.add(now, removed)
+		}
+		paused = false
+		os.Remove(confirm)
+
+		if err := buildGeneration(ctx, c, generations, current, manifest, generation.Seq, versions); err != nil {
+			fmt.Println("Failed to build generation", generation.Seq, "of", c.Key, err)
+			continue
+		}
+		writeManifest(generations, generation.Seq, versions)
+		if err := switchGeneration(monitored, filepath.Join(generations, fmt.Sprint(generation.Seq))); err != nil {
+			fmt.Println("Failed to switch", monitored, "to generation", generation.Seq, err)
+			os.Remove(filepath.Join(generations, fmt.Sprint(generation.Seq, ".json")))
+			continue
+		}
+		fmt.Println("Switched", monitored, "to generation", generation.Seq)
+		removeGenerations(generations, current)
+		current, manifest = generation.Seq, toManifest(versions)
+		seen = current
+		sleepTime = time.Second
+	}
+}
+
+// buildGeneration writes the files of versions into <generations>/<seq>.
+// Files whose content the previous generation has are hard linked or copied
+// from it, the rest is downloaded.
+func buildGeneration(ctx context.Context, c *Client, generations string, previous int64, manifest map[string]string,
+	seq int64, versions []index.FileVersion) error {
+	staging := filepath.Join(generations, fmt.Sprint(seq, ".staging"))
+	os.RemoveAll(staging)
+	byHash := make(map[string]string)
+	for filePath, fileHash := range manifest {
+		byHash[fileHash] = filePath
+	}
+	previousDir := filepath.Join(generations, fmt.Sprint(previous))
+	for _, version := range versions {
+		target := filepath.Join(staging, filepath.FromSlash(version.FilePath))
+		if err := os.MkdirAll(filepath.Dir(target), os.FileMode(0755)); err != nil {
+			os.RemoveAll(staging)
+			return err
+		}
+		if from, ok := byHash[version.FileHash]; ok && version.FileHash != "" {
+			if err := linkOrCopy(filepath.Join(previousDir, filepath.FromSlash(from)), target, version); err == nil {
+				continue
+			}
+		}
+		if err := c.RestoreVersion(ctx, version, target); err != nil {
+			os.RemoveAll(staging)
+			return err
+		}
+	}
+	if len(versions) == 0 {
+		if err := os.MkdirAll(staging, os.FileMode(0755)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(staging, filepath.Join(generations, fmt.Sprint(seq)))
+}
+
+// linkOrCopy makes to a file with the content of from and the mode and
+// mtime of version.
+func linkOrCopy(from string, to string, version index.FileVersion) error {
+	info, err := os.Stat(from)
+	if err != nil || info.Size() != version.FileSize {
+		return fmt.Errorf("%s doesn't match", from)
+	}
+	modified := time.Unix(version.LastModified, 0)
+	if info.Mode().Perm() == version.FileMode && info.ModTime().Unix() == version.LastModified {
+		if err := os.Link(from, to); err == nil {
+			return nil
+		}
+	}
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, version.FileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := copySparse(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	os.Chmod(to, version.FileMode)
+	return os.Chtimes(to, modified, modified)
+}
+
+// switchGeneration points the symlink monitored to dir. Replacing the
+// symlink by a rename is atomic. A directory at monitored, from before
+// snapshot mode was enabled, is moved to SNAPSHOT_ORIGINAL in the
+// generations once, and left there for the user, it may hold files only
+// this copy has.
+func switchGeneration(monitored string, dir string) error {
+	monitored = strings.TrimSuffix(monitored, "/")
+	if info, err := os.Lstat(monitored); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		// an empty directory has nothing to keep
+		if !info.IsDir() || os.Remove(monitored) != nil {
+			original := filepath.Join(GenerationsDir(monitored), SNAPSHOT_ORIGINAL)
+			if _, err := os.Lstat(original); err == nil {
+				original += "-" + time.Now().Format(TRASH_TIME_FORMAT)
+			}
+			fmt.Println("Moving", monitored, "to", original, "for snapshot mode, it is kept until removed by hand")
+			if err := os.Rename(monitored, original); err != nil {
+				return err
+			}
+		}
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	link := monitored + GENERATIONS_SUFFIX + ".link"
+	os.Remove(link)
+	if err := os.Symlink(absDir, link); err != nil {
+		return err
+	}
+	return os.Rename(link, monitored)
+}
+
+// removeGenerations removes the generations older than keep.
+func removeGenerations(generations string, keep int64) {
+	infos, _ := ioutil.ReadDir(generations)
+	for _, info := range infos {
+		name := strings.TrimSuffix(strings.TrimSuffix(info.Name(), ".json"), ".staging")
+		seq, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || seq >= keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(generations, info.Name())); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// currentGeneration returns the newest generation in generations that has a
+// manifest, and its manifest.
+func currentGeneration(generations string) (int64, map[string]string) {
+	infos, _ := ioutil.ReadDir(generations)
+	seqs := make([]int64, 0)
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		if seq, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), ".json"), 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] > seqs[j]
+	})
+	for _, seq := range seqs {
+		b, err := ioutil.ReadFile(filepath.Join(generations, fmt.Sprint(seq, ".json")))
+		if err != nil {
+			continue
+		}
+		var versions []index.FileVersion
+		if json.Unmarshal(b, &versions) == nil {
+			return seq, toManifest(versions)
+		}
+	}
+	return 0, make(map[string]string)
+}
+
+// writeManifest records the versions of generation seq in <seq>.json, the
+// hashes of the files let the next generation reuse them.
+func writeManifest(generations string, seq int64, versions []index.FileVersion) {
+	b, _ := json.Marshal(versions)
+	tmp := filepath.Join(generations, fmt.Sprint(seq, ".json.tmp"))
+	if err := ioutil.WriteFile(tmp, b, os.FileMode(0644)); err != nil {
+		fmt.Println(err)
+		return
+	}
+	os.Rename(tmp, filepath.Join(generations, fmt.Sprint(seq, ".json")))
+}
+
+// toManifest maps the paths of versions to their content hashes.
+func toManifest(versions []index.FileVersion) map[string]string {
+	manifest := make(map[string]string)
+	for _, version := range versions {
+		manifest[version.FilePath] = version.FileHash
+	}
+	return manifest
+}
+
+func sameSnapshot(manifest map[string]string, versions []index.FileVersion) bool {
+	if len(manifest) != len(versions) {
+		return false
+	}
+	for _, version := range versions {
+		if fileHash, ok := manifest[version.FilePath]; !ok || fileHash != version.FileHash {
+			return false
+		}
+	}
+	return true
+}
+
+func inSnapshot(versions []index.FileVersion, filePath string) bool {
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].FilePath >= filePath
+	})
+	return i < len(versions) && versions[i].FilePath == filePath
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwitchGenerationKeepsOriginal(t *testing.T) {
+	monitored := filepath.Join(t.TempDir(), "data")
+	generations := GenerationsDir(monitored)
+	os.MkdirAll(monitored, 0755)
+	os.WriteFile(filepath.Join(monitored, "local.txt"), []byte("local"), 0644)
+	for _, seq := range []string{"1", "2"} {
+		if err := os.MkdirAll(filepath.Join(generations, seq), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := switchGeneration(monitored, filepath.Join(generations, "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := switchGeneration(monitored, filepath.Join(generations, "2")); err != nil {
+		t.Fatal(err)
+	}
+	removeGenerations(generations, 2)
+
+	b, err := os.ReadFile(filepath.Join(generations, SNAPSHOT_ORIGINAL, "local.txt"))
+	if err != nil || string(b) != "local" {
+		t.Fatalf("the file only the original directory had is lost: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(generations, "1")); err == nil {
+		t.Error("generation 1 is kept")
+	}
+	if target, _ := os.Readlink(monitored); filepath.Base(target) != "2" {
+		t.Errorf("%s points to %s, want generation 2", monitored, target)
+	}
+}
+
+func TestSwitchGenerationEmptyDir(t *testing.T) {
+	monitored := filepath.Join(t.TempDir(), "data")
+	generations := GenerationsDir(monitored)
+	os.MkdirAll(monitored, 0755)
+	os.MkdirAll(filepath.Join(generations, "1"), 0755)
+	if err := switchGeneration(monitored, filepath.Join(generations, "1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(generations, SNAPSHOT_ORIGINAL)); err == nil {
+		t.Error("an empty directory is kept")
+	}
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"bytes"
+	"github.com/elgs/filesync/index"
+	"io"
+	"os"
+)
+
+// copySparse copies in to out, seeking over the blocks that are all zeros
+// instead of writing them, so they stay holes on filesystems that support
+// them. It returns the number of bytes copied.
+func copySparse(out *os.File, in io.Reader) (int64, error) {
+	buf := make([]byte, index.BLOCK_SIZE)
+	zeros := make([]byte, index.BLOCK_SIZE)
+	var written int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zeros[:n]) {
+				if _, err := out.Seek(int64(n), io.SeekCurrent); err != nil {
+					return written, err
+				}
+			} else if _, err := out.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a hole at the end needs the size set
+			return written, out.Truncate(written)
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
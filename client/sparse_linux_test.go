@@ -0,0 +1,16 @@
+package client
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// allocated returns the bytes the filesystem allocated for thePath.
+func allocated(t *testing.T, thePath string) int64 {
+	info, err := os.Stat(thePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package client
+
+import (
+	"testing"
+)
+
+// allocated is -1 where the allocated size isn't known.
+func allocated(t *testing.T, thePath string) int64 {
+	return -1
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"bytes"
+	"github.com/elgs/filesync/index"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopySparse(t *testing.T) {
+	block := index.BLOCK_SIZE
+	for _, c := range []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"hole in the middle", append(append(filled(block, 'a'), filled(4*block, 0)...), filled(10, 'b')...)},
+		{"hole at the end", append(filled(block, 'a'), filled(4*block+10, 0)...)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			thePath := filepath.Join(t.TempDir(), "f.bin")
+			out, err := os.Create(thePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := copySparse(out, bytes.NewReader(c.content))
+			out.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(c.content)) {
+				t.Fatalf("copied %d of %d bytes", n, len(c.content))
+			}
+			if got, _ := os.ReadFile(thePath); !bytes.Equal(got, c.content) {
+				t.Fatal("the copy differs")
+			}
+			// the zeros aren't written where the filesystem keeps holes
+			if size := allocated(t, thePath); size >= 0 && len(c.content) > 0 && size >= int64(len(c.content)) {
+				t.Errorf("%d bytes allocated for %d bytes with 4 blocks of zeros", size, len(c.content))
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MAX_INTERVAL is the default for how far syncers back off between two
+// looks at a server that reports nothing new.
+const MAX_INTERVAL = time.Minute
+
+// STOP_GRACE is the default for how long a stopped syncer lets the file it
+// is downloading finish.
+const STOP_GRACE = 30 * time.Second
+
+// Syncer keeps the local directory Monitored in line with the monitor of
+// Client. It asks the server for what was indexed since its previous cycle,
+// backing off from a second up to MaxInterval while nothing changes.
+type Syncer struct {
+	Client    *Client
+	Monitored string
+	// MaxInterval is MAX_INTERVAL if zero.
+	MaxInterval time.Duration
+	// KeepTrash is how long files deleted on the server are kept in the
+	// trash, 0 deletes them right away.
+	KeepTrash time.Duration
+	Brake     DeleteBrake
+	// Cache finds blocks held locally, it can be shared by the syncers of
+	// several monitors. Run seeds it with the files in Monitored. No blocks
+	// are copied if it is nil.
+	Cache *BlockCache
+	// StopGrace is how long the file being synced when ctx is done may take
+	// to finish, STOP_GRACE if zero.
+	StopGrace time.Duration
+}
+
+// Run syncs until ctx is done, or until a brake with Exit set trips. Once
+// ctx is done no other file is started, and the file being synced is given
+// StopGrace to finish. Run then returns ctx.Err(), or an error naming the
+// file that was cut short, whose copy is synced again on the next run.
+func (s *Syncer) Run(ctx context.Context) error {
+	c, monitored := s.Client, s.Monitored
+	maxInterval := s.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = MAX_INTERVAL
+	}
+	stopGrace := s.StopGrace
+	if stopGrace <= 0 {
+		stopGrace = STOP_GRACE
+	}
+	// requests outlive ctx by the grace
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stopAfter := context.AfterFunc(ctx, func() {
+		time.AfterFunc(stopGrace, cancel)
+	})
+	defer stopAfter()
+	// the copies already here are block sources too, found while syncing
+	go s.Cache.Seed(ctx, monitored)
+	var lastIndexed int64 = 0
+	var changed bool = false
+	var paused bool = false
+	var window deleteWindow
+	local := localCount{monitored: monitored}
+	sleepTime := time.Second
+	for {
+		if changed {
+			sleepTime = time.Second
+		} else {
+			sleepTime *= 2
+			if sleepTime >= maxInterval {
+				sleepTime = maxInterval
+			}
+		}
+		changed = false
+		//fmt.Println("Sleep", sleepTime, lastIndexed)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleepTime):
+		}
+		if s.KeepTrash > 0 {
+			purgeTrash(monitored, s.KeepTrash)
+		}
+		deleted := time.Now()
+		dirs, err := c.Dirs(ctx, lastIndexed-3600)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if len(dirs) == 0 {
+			continue
+		}
+		files, err := c.Files(ctx, "/", lastIndexed-3600)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		// the deletes of paths restored from the trash since are left out
+		var indexed int64
+		for _, entry := range append(append([]index.IndexedFile(nil), dirs...), files...) {
+			if entry.LastIndexed > indexed {
+				indexed = entry.LastIndexed
+			}
+		}
+		restored := restoredPaths(monitored)
+		dirs, files = withoutRestored(dirs, restored), withoutRestored(files, restored)
+		entries := append(append([]index.IndexedFile(nil), dirs...), files...)
+
+		// rename what was moved on the server before anything is deleted or
+		// downloaded
+		for _, entry := range entries {
+			if moveLocal(monitored, entry) {
+				changed = true
+			}
+		}
+
+		// hold back a cycle that deletes too much until it is confirmed
+		confirm := BrakeConfirm(monitored)
+		now := time.Now()
+		recent := window.count(now, s.Brake.window())
+		affected, total, tripped := s.Brake.check(localDeletes(monitored, entries), recent, &local, now)
+		_, err = os.Lstat(confirm)
+		if tripped && err != nil {
+			if !paused {
+				paused = true
+				fmt.Printf("ALERT: %s would delete %d of %d entries in %s, %d more within %v, confirm with gsync confirm-deletes %s\n",
+					c.Key, affected, total, monitored, recent, s.Brake.window(), c.Key)
+				if s.Brake.Exit {
+					return &BrakeError{monitored, affected + recent, total + recent}
+				}
+				fmt.Println("Paused", monitored, "until the deletes are confirmed or no longer reported")
+			}
+			continue
+		}
+		if tripped {
+			fmt.Println("Applying", affected, "confirmed deletes in", monitored)
+			window.reset()
+		} else {
+			if paused {
+				fmt.Println("Deletes in", monitored, "are back under the limit, resuming")
+			}
+			window.add(now, affected)
+		}
+		local.deleted(affected)
+		paused = false
+		os.Remove(confirm)
+
+		for _, dir := range dirs {
+			if InTrash(dir.FilePath) {
+				continue
+			}
+			thePath := index.PathSafe(index.SlashSuffix(monitored) + dir.FilePath)
+			if dir.Status == "deleted" {
+				if err := s.remove(thePath, deleted, indexed); err != nil {
+					fmt.Println(err)
+				}
+				continue
+			}
+			err := os.MkdirAll(thePath, dir.FileMode)
+			if err == nil && dir.FileMode != 0 {
+				// MkdirAll leaves the mode of an existing directory
+				err = os.Chmod(thePath, dir.FileMode)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		// hard links last, after the file they link to
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].LinkedTo == "" && files[j].LinkedTo != ""
+		})
+		for _, file := range files {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if file.LastIndexed > lastIndexed {
+				lastIndexed = file.LastIndexed
+			}
+
+			if InTrash(file.FilePath) {
+				continue
+			}
+			if linkLocal(monitored, file) {
+				changed = true
+				continue
+			}
+			thePath := index.PathSafe(index.SlashSuffix(monitored) + file.FilePath)
+			if file.Status == "deleted" {
+				if err := s.remove(thePath, deleted, indexed); err != nil {
+					fmt.Println(err)
+				}
+				continue
+			}
+			fileChanged, err := c.SyncFile(work, file, thePath, s.Cache)
+			if err != nil && work.Err() != nil {
+				return fmt.Errorf("stopped while syncing %s: %w", thePath, ctx.Err())
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+			if fileChanged {
+				changed = true
+			}
+		}
+	}
+}
+
+// remove deletes the local copy of a path deleted on the server, by moving
+// it to the trash unless the trash is disabled.
+func (s *Syncer) remove(thePath string, deleted time.Time, indexed int64) error {
+	if s.KeepTrash <= 0 {
+		return os.RemoveAll(thePath)
+	}
+	return trash(s.Monitored, thePath, deleted, indexed)
+}
+
+// moveLocal renames the local copy of an entry the server reports as moved
+// from another path. The copy is only moved if nothing exists at the new path
+// yet, and for a file if its content matches the server's.
+func moveLocal(monitored string, entry index.IndexedFile) bool {
+	if entry.MovedFrom == "" || entry.Status != "ready" {
+		return false
+	}
+	if InTrash(entry.FilePath) || InTrash(entry.MovedFrom) {
+		return false
+	}
+	from := index.PathSafe(index.SlashSuffix(monitored) + entry.MovedFrom)
+	to := index.PathSafe(index.SlashSuffix(monitored) + entry.FilePath)
+	if _, err := os.Lstat(to); err == nil {
+		return false
+	}
+	info, err := os.Lstat(from)
+	if err != nil {
+		return false
+	}
+	if entry.FileSize < 0 {
+		if !info.IsDir() {
+			return false
+		}
+	} else if info.IsDir() || info.Size() != entry.FileSize || entry.FileHash == "" || index.HashFile(from) != entry.FileHash {
+		return false
+	}
+	os.MkdirAll(filepath.Dir(strings.TrimSuffix(to, "/")), os.FileMode(0755))
+	if err := os.Rename(strings.TrimSuffix(from, "/"), strings.TrimSuffix(to, "/")); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+// linkLocal makes the local copy of a file the server reports as a hard link
+// a link to the local copy of the file it is LinkedTo, which is only done if
+// that one's content matches the server's. It reports whether the copy is
+// such a link, the file is synced as usual otherwise.
+func linkLocal(monitored string, entry index.IndexedFile) bool {
+	if entry.LinkedTo == "" || entry.Status != "ready" {
+		return false
+	}
+	if InTrash(entry.FilePath) || InTrash(entry.LinkedTo) {
+		return false
+	}
+	from := index.PathSafe(index.SlashSuffix(monitored) + entry.LinkedTo)
+	to := index.PathSafe(index.SlashSuffix(monitored) + entry.FilePath)
+	info, err := os.Lstat(from)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if info.Size() != entry.FileSize || entry.FileHash == "" || index.HashFile(from) != entry.FileHash {
+		return false
+	}
+	if toInfo, err := os.Lstat(to); err == nil && os.SameFile(info, toInfo) {
+		return true
+	}
+	os.MkdirAll(filepath.Dir(to), os.FileMode(0755))
+	// linked next to it first, so the copy is replaced in one step
+	tmp := filepath.Join(filepath.Dir(to), ".gsync-link-"+filepath.Base(to))
+	os.Remove(tmp)
+	if err := os.Link(from, tmp); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	if err := os.Rename(tmp, to); err != nil {
+		fmt.Println(err)
+		os.Remove(tmp)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TRASH_DIR is the directory in each monitored directory that deleted files
+// are moved to, under a directory named by the time of deletion.
+const TRASH_DIR = ".gsync-trash"
+
+// TRASH_TIME_FORMAT names the directories in TRASH_DIR, in local time.
+const TRASH_TIME_FORMAT = "2006-01-02_15-04-05.000000000"
+
+// TRASH_INDEXED_SUFFIX names the file next to a directory in TRASH_DIR that
+// holds the latest LastIndexed of the server's entries in the cycle that
+// filled it. A delete indexed after that wasn't applied yet.
+const TRASH_INDEXED_SUFFIX = ".indexed"
+
+// RESTORED_FILE lists, in TRASH_DIR, the paths moved back out of the trash
+// to where they were, each with the LastIndexed up to which the server's
+// deletes of it were applied already.
+const RESTORED_FILE = "restored"
+
+// InTrash reports whether filePath, relative to the monitored directory, is
+// the trash or lies inside it. The server's entries there are never applied.
+func InTrash(filePath string) bool {
+	filePath = strings.TrimPrefix(filePath, "/")
+	return filePath == TRASH_DIR || strings.HasPrefix(filePath, TRASH_DIR+"/")
+}
+
+// trash moves thePath, a path in monitored, to the trash directory of the
+// deletion time deleted, the cycle in which the server's entries were
+// indexed up to indexed. Nothing happens if thePath doesn't exist.
+func trash(monitored string, thePath string, deleted time.Time, indexed int64) error {
+	if _, err := os.Lstat(thePath); os.IsNotExist(err) {
+		return nil
+	}
+	rel, err := filepath.Rel(monitored, thePath)
+	if err != nil {
+		return err
+	}
+	if rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("refusing to trash %s, it isn't in %s", thePath, monitored)
+	}
+	name := deleted.Format(TRASH_TIME_FORMAT)
+	target := filepath.Join(monitored, TRASH_DIR, name, rel)
+	if err := os.MkdirAll(filepath.Dir(target), os.FileMode(0755)); err != nil {
+		return err
+	}
+	indexedFile := filepath.Join(monitored, TRASH_DIR, name+TRASH_INDEXED_SUFFIX)
+	if _, err := os.Stat(indexedFile); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(indexedFile, []byte(fmt.Sprintln(indexed)), os.FileMode(0644)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(filepath.Clean(thePath), target)
+}
+
+// MarkRestored records that rel, a path relative to monitored, was moved
+// back to where it was from the trash directory name. The deletes of it
+// the server reported before it was trashed are no longer applied, the
+// syncer reports them again for an hour and on every start.
+func MarkRestored(monitored string, name string, rel string) error {
+	b, err := ioutil.ReadFile(filepath.Join(monitored, TRASH_DIR, name+TRASH_INDEXED_SUFFIX))
+	indexed, parseErr := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || parseErr != nil {
+		// trashed by an older gsync, the restore time has to do
+		indexed = time.Now().Unix()
+	}
+	out, err := os.OpenFile(filepath.Join(monitored, TRASH_DIR, RESTORED_FILE), os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%d\t/%s\n", indexed, filepath.ToSlash(rel))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// restoredPaths returns the paths of monitored restored from the trash,
+// with the LastIndexed up to which their deletes are no longer applied.
+func restoredPaths(monitored string) map[string]int64 {
+	restored := make(map[string]int64)
+	in, err := os.Open(filepath.Join(monitored, TRASH_DIR, RESTORED_FILE))
+	if err != nil {
+		return restored
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if indexed, err := strconv.ParseInt(fields[0], 10, 64); err == nil && indexed > restored[fields[1]] {
+			restored[fields[1]] = indexed
+		}
+	}
+	return restored
+}
+
+// withoutRestored returns entries without the deletes of paths restored
+// from the trash that were applied before the restore.
+func withoutRestored(entries []index.IndexedFile, restored map[string]int64) []index.IndexedFile {
+	if len(restored) == 0 {
+		return entries
+	}
+	result := make([]index.IndexedFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Status == "deleted" && restoredBefore(entry, restored) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// restoredBefore reports whether entry, or a directory it is in, was
+// restored after the delete of entry was applied.
+func restoredBefore(entry index.IndexedFile, restored map[string]int64) bool {
+	filePath := strings.TrimSuffix(entry.FilePath, "/")
+	for {
+		if indexed, ok := restored[filePath]; ok && entry.LastIndexed <= indexed {
+			return true
+		}
+		i := strings.LastIndex(filePath, "/")
+		if i <= 0 {
+			return false
+		}
+		filePath = filePath[:i]
+	}
+}
+
+// TrashEntries returns the deletion times in the trash of monitored, the
+// oldest first, keyed by the name of their directory.
+func TrashEntries(monitored string) ([]string, map[string]time.Time) {
+	infos, _ := ioutil.ReadDir(filepath.Join(monitored, TRASH_DIR))
+	names := make([]string, 0, len(infos))
+	times := make(map[string]time.Time)
+	for _, info := range infos {
+		deleted, err := time.ParseInLocation(TRASH_TIME_FORMAT, info.Name(), time.Local)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		names = append(names, info.Name())
+		times[info.Name()] = deleted
+	}
+	sort.Strings(names)
+	return names, times
+}
+
+// purgeTrash removes what was deleted from monitored more than keep ago.
+func purgeTrash(monitored string, keep time.Duration) {
+	names, times := TrashEntries(monitored)
+	for _, name := range names {
+		if time.Since(times[name]) < keep {
+			break
+		}
+		if err := os.RemoveAll(filepath.Join(monitored, TRASH_DIR, name)); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		os.Remove(filepath.Join(monitored, TRASH_DIR, name+TRASH_INDEXED_SUFFIX))
+	}
+}
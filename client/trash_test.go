@@ -0,0 +1,67 @@
+package client
+
+import (
+	"github.com/elgs/filesync/index"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoredDeletes(t *testing.T) {
+	monitored := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(monitored, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(monitored, "docs", "a.txt"), []byte("a"), 0644)
+
+	deleted := time.Now()
+	if err := trash(monitored, filepath.Join(monitored, "docs"), deleted, 100); err != nil {
+		t.Fatal(err)
+	}
+	name := deleted.Format(TRASH_TIME_FORMAT)
+	if err := os.Rename(filepath.Join(monitored, TRASH_DIR, name, "docs"), filepath.Join(monitored, "docs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := MarkRestored(monitored, name, "docs"); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := restoredPaths(monitored)
+	if restored["/docs"] != 100 {
+		t.Fatalf("restoredPaths = %v, want /docs up to 100", restored)
+	}
+	entries := []index.IndexedFile{
+		{FilePath: "/docs/", Status: "deleted", LastIndexed: 100},
+		{FilePath: "/docs/a.txt", Status: "deleted", LastIndexed: 99},
+		{FilePath: "/docs/b.txt", Status: "deleted", LastIndexed: 101},
+		{FilePath: "/docs/c.txt", Status: "ready", LastIndexed: 50},
+		{FilePath: "/docsx.txt", Status: "deleted", LastIndexed: 50},
+	}
+	kept := withoutRestored(entries, restored)
+	want := []string{"/docs/b.txt", "/docs/c.txt", "/docsx.txt"}
+	if len(kept) != len(want) {
+		t.Fatalf("withoutRestored kept %v, want %v", kept, want)
+	}
+	for i, entry := range kept {
+		if entry.FilePath != want[i] {
+			t.Errorf("withoutRestored kept %s, want %s", entry.FilePath, want[i])
+		}
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	monitored := t.TempDir()
+	os.WriteFile(filepath.Join(monitored, "a.txt"), []byte("a"), 0644)
+	deleted := time.Now().Add(-2 * time.Hour)
+	if err := trash(monitored, filepath.Join(monitored, "a.txt"), deleted, 100); err != nil {
+		t.Fatal(err)
+	}
+	purgeTrash(monitored, time.Hour)
+	name := deleted.Format(TRASH_TIME_FORMAT)
+	for _, gone := range []string{name, name + TRASH_INDEXED_SUFFIX} {
+		if _, err := os.Lstat(filepath.Join(monitored, TRASH_DIR, gone)); err == nil {
+			t.Errorf("%s is left after purging", gone)
+		}
+	}
+}
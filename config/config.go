@@ -0,0 +1,432 @@
+// Package config reads the config files of gsyncd and gsync into a Server
+// or a Client. A file is JSON, YAML or TOML by its extension and is decoded
+// strictly, a setting that isn't known or has the wrong type is an error.
+// Every setting can then be overridden by an environment variable. Reloads
+// tells when a file is to be read again.
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/elgs/filesync/client"
+	"github.com/elgs/filesync/index"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SHUTDOWN_TIMEOUT is the default for how long gsyncd waits for downloads
+// and indexing in progress once it is told to stop.
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// Server is what gsyncd.json sets.
+type Server struct {
+	IP              string                   `json:"ip" yaml:"ip" toml:"ip"`
+	Port            int                      `json:"port" yaml:"port" toml:"port"`
+	IndexStore      string                   `json:"index_store" yaml:"index_store" toml:"index_store"`
+	ShutdownTimeout Duration                 `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	Monitors        map[string]ServerMonitor `json:"monitors" yaml:"monitors" toml:"monitors"`
+}
+
+// NewServer returns the defaults of gsyncd.json.
+func NewServer() *Server {
+	return &Server{
+		IP:              "127.0.0.1",
+		Port:            6776,
+		ShutdownTimeout: Duration(SHUTDOWN_TIMEOUT),
+	}
+}
+
+// ServerMonitor is a monitor of gsyncd.json. It is given as an object, or
+// by its path only. A patrol_interval of 0 disables the patrol.
+type ServerMonitor struct {
+	Path           string   `json:"path" yaml:"path" toml:"path"`
+	IndexPath      string   `json:"index_path" yaml:"index_path" toml:"index_path"`
+	BlockStore     bool     `json:"block_store" yaml:"block_store" toml:"block_store"`
+	History        *History `json:"history" yaml:"history" toml:"history"`
+	WriteQuiet     Duration `json:"write_quiet" yaml:"write_quiet" toml:"write_quiet"`
+	WriteMaxWait   Duration `json:"write_max_wait" yaml:"write_max_wait" toml:"write_max_wait"`
+	Workers        int      `json:"workers" yaml:"workers" toml:"workers"`
+	QueueSize      int      `json:"queue_size" yaml:"queue_size" toml:"queue_size"`
+	PatrolInterval Duration `json:"patrol_interval" yaml:"patrol_interval" toml:"patrol_interval"`
+	PatrolBatch    int      `json:"patrol_batch" yaml:"patrol_batch" toml:"patrol_batch"`
+	Watcher        string   `json:"watcher" yaml:"watcher" toml:"watcher"`
+	PollInterval   Duration `json:"poll_interval" yaml:"poll_interval" toml:"poll_interval"`
+}
+
+// History is the history setting of a monitor, see index.History.
+type History struct {
+	Versions int `json:"versions" yaml:"versions" toml:"versions"`
+	Days     int `json:"days" yaml:"days" toml:"days"`
+}
+
+// serverMonitor is a ServerMonitor without its decoding methods.
+type serverMonitor ServerMonitor
+
+func (m *ServerMonitor) defaults() {
+	*m = ServerMonitor{
+		WriteQuiet:     Duration(index.WRITE_QUIET),
+		WriteMaxWait:   Duration(index.WRITE_MAX_WAIT),
+		Workers:        index.INDEX_WORKERS,
+		QueueSize:      index.INDEX_QUEUE_SIZE,
+		PatrolInterval: Duration(index.PATROL_INTERVAL),
+		PatrolBatch:    index.PATROL_BATCH,
+		Watcher:        index.WATCHER_AUTO,
+		PollInterval:   Duration(index.POLL_INTERVAL),
+	}
+}
+
+func (m *ServerMonitor) UnmarshalJSON(b []byte) error {
+	m.defaults()
+	return decodeJSONMonitor(b, (*serverMonitor)(m), &m.Path)
+}
+
+func (m *ServerMonitor) UnmarshalYAML(node *yaml.Node) error {
+	m.defaults()
+	return decodeYAMLMonitor(node, (*serverMonitor)(m), &m.Path)
+}
+
+func (m *ServerMonitor) UnmarshalTOML(data interface{}) error {
+	m.defaults()
+	return decodeTOMLMonitor(data, (*serverMonitor)(m), &m.Path)
+}
+
+// Client is what gsync.json sets. The settings but the monitors apply to
+// every monitor.
+type Client struct {
+	IP   string `json:"ip" yaml:"ip" toml:"ip"`
+	Port int    `json:"port" yaml:"port" toml:"port"`
+	// TrashDays is how long files deleted on the server are kept in the
+	// trash, 0 deletes them right away.
+	TrashDays int `json:"trash_days" yaml:"trash_days" toml:"trash_days"`
+	// ShutdownTimeout is how long the files being downloaded may take to
+	// finish on a signal.
+	ShutdownTimeout Duration                 `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	DeleteBrake     DeleteBrake              `json:"delete_brake" yaml:"delete_brake" toml:"delete_brake"`
+	Monitors        map[string]ClientMonitor `json:"monitors" yaml:"monitors" toml:"monitors"`
+}
+
+// NewClient returns the defaults of gsync.json.
+func NewClient() *Client {
+	return &Client{
+		IP:              "127.0.0.1",
+		Port:            6776,
+		TrashDays:       30,
+		ShutdownTimeout: Duration(client.STOP_GRACE),
+		DeleteBrake: DeleteBrake{
+			Percent: 20,
+			Count:   1000,
+			Window:  Duration(client.BRAKE_WINDOW),
+		},
+	}
+}
+
+// DeleteBrake is the delete_brake setting, see client.DeleteBrake.
+type DeleteBrake struct {
+	Percent int      `json:"percent" yaml:"percent" toml:"percent"`
+	Count   int      `json:"count" yaml:"count" toml:"count"`
+	Window  Duration `json:"window" yaml:"window" toml:"window"`
+	Exit    bool     `json:"exit" yaml:"exit" toml:"exit"`
+}
+
+// ClientMonitor is a monitor of gsync.json, given as an object or by its
+// local path only. Snapshot syncs whole generations.
+type ClientMonitor struct {
+	Path     string `json:"path" yaml:"path" toml:"path"`
+	Snapshot bool   `json:"snapshot" yaml:"snapshot" toml:"snapshot"`
+}
+
+// clientMonitor is a ClientMonitor without its decoding methods.
+type clientMonitor ClientMonitor
+
+func (m *ClientMonitor) UnmarshalJSON(b []byte) error {
+	*m = ClientMonitor{}
+	return decodeJSONMonitor(b, (*clientMonitor)(m), &m.Path)
+}
+
+func (m *ClientMonitor) UnmarshalYAML(node *yaml.Node) error {
+	*m = ClientMonitor{}
+	return decodeYAMLMonitor(node, (*clientMonitor)(m), &m.Path)
+}
+
+func (m *ClientMonitor) UnmarshalTOML(data interface{}) error {
+	*m = ClientMonitor{}
+	return decodeTOMLMonitor(data, (*clientMonitor)(m), &m.Path)
+}
+
+// Duration is a duration written such as "1s" or "500ms". It can't be
+// negative.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	parsed, err := time.ParseDuration(string(b))
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("%q is not a duration such as 1s or 500ms", b)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// The monitors are decoded by their own decoders, as a string is their
+// path. The decoders are as strict as the one of the file.
+
+func decodeJSONMonitor(b []byte, v interface{}, path *string) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, path)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func decodeYAMLMonitor(node *yaml.Node, v interface{}, path *string) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(path)
+	}
+	// node.Decode doesn't know of unknown fields
+	b, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	err = decoder.Decode(v)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// the lines are counted from the monitor, and the decoder of the
+		// file goes on after type errors
+		errs := make([]string, len(typeErr.Errors))
+		for i, e := range typeErr.Errors {
+			var line int
+			var rest string
+			if n, _ := fmt.Sscanf(e, "line %d:", &line); n == 1 {
+				rest = e[strings.Index(e, ":"):]
+				e = fmt.Sprintf("line %d%s", node.Line+line-1, rest)
+			}
+			errs[i] = e
+		}
+		return &yaml.TypeError{Errors: errs}
+	}
+	return err
+}
+
+func decodeTOMLMonitor(data interface{}, v interface{}, path *string) error {
+	if s, ok := data.(string); ok {
+		*path = s
+		return nil
+	}
+	table, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%v is neither a path nor a table", data)
+	}
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(table); err != nil {
+		return err
+	}
+	md, err := toml.Decode(b.String(), v)
+	if err != nil {
+		return err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("unknown setting %s", undecoded[0])
+	}
+	return nil
+}
+
+// Load reads file into v, a Server or Client holding the defaults, by its
+// extension .yaml or .yml as YAML, .toml as TOML and as JSON otherwise, and
+// applies the environment variables named after envPrefix and the path of
+// a setting: with GSYNCD the port is overridden by GSYNCD_PORT and the
+// workers of the monitor docs by GSYNCD_MONITORS_DOCS_WORKERS. A file that
+// can't be read or decoded is an error. The problems of the variables are
+// returned, the caller adds those it finds and reports them with Err.
+func Load(file string, envPrefix string, v interface{}) (*Error, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found", file)
+	}
+	problems := &Error{File: file}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(b))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(v); err != nil && err != io.EOF {
+			problems.Problem("", "%v", err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), v)
+		if err != nil {
+			problems.Problem("", "%v", err)
+			break
+		}
+		for _, key := range md.Undecoded() {
+			// the monitors report theirs when they are decoded
+			if len(key) > 2 && key[0] == "monitors" {
+				continue
+			}
+			problems.Problem(key.String(), "unknown setting")
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(v); err != nil && err != io.EOF {
+			problems.Problem("", "%v", err)
+		}
+	}
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+	applyEnv(envPrefix, "", reflect.ValueOf(v).Elem(), problems)
+	return problems, nil
+}
+
+// applyEnv sets the settings of the struct v at path from the environment.
+// Only monitors set in the file are looked at.
+func applyEnv(envPrefix string, path string, v reflect.Value, problems *Error) {
+	if envPrefix == "" {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		if path != "" {
+			key = path + "." + key
+		}
+		field := v.Field(i)
+		if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			if s, ok := lookupEnv(envPrefix, key); ok {
+				if err := u.UnmarshalText([]byte(s)); err != nil {
+					problems.Problem(key, "%v", err)
+				}
+			}
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Map:
+			names := make([]string, 0, field.Len())
+			for _, name := range field.MapKeys() {
+				names = append(names, name.String())
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				// map values can't be set in place
+				value := reflect.New(field.Type().Elem()).Elem()
+				value.Set(field.MapIndex(reflect.ValueOf(name)))
+				applyEnv(envPrefix, key+"."+name, value, problems)
+				field.SetMapIndex(reflect.ValueOf(name), value)
+			}
+		case reflect.Ptr:
+			if !field.IsNil() {
+				applyEnv(envPrefix, key, field.Elem(), problems)
+			}
+		case reflect.Struct:
+			applyEnv(envPrefix, key, field, problems)
+		case reflect.String:
+			if s, ok := lookupEnv(envPrefix, key); ok {
+				field.SetString(s)
+			}
+		case reflect.Int:
+			if s, ok := lookupEnv(envPrefix, key); ok {
+				if n, err := strconv.Atoi(s); err == nil {
+					field.SetInt(int64(n))
+				} else {
+					problems.Problem(key, "%q is not an integer", s)
+				}
+			}
+		case reflect.Bool:
+			if s, ok := lookupEnv(envPrefix, key); ok {
+				if b, err := strconv.ParseBool(s); err == nil {
+					field.SetBool(b)
+				} else {
+					problems.Problem(key, "%q is not true or false", s)
+				}
+			}
+		}
+	}
+}
+
+// lookupEnv returns the environment variable overriding the setting at
+// path. Characters other than letters and digits become _.
+func lookupEnv(envPrefix string, path string) (string, bool) {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, envPrefix+"_"+path)
+	return os.LookupEnv(name)
+}
+
+// Error lists every problem found in a config file.
+type Error struct {
+	File     string
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		lines[i] = e.File + ": " + problem
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Problem records a problem with the setting at path.
+func (e *Error) Problem(path string, format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	if path != "" {
+		message = path + ": " + message
+	}
+	e.Problems = append(e.Problems, message)
+}
+
+// Err returns e, nil if it has no problems.
+func (e *Error) Err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// CheckOverlap records a problem for every two of dirs, directories by the
+// key of their monitor, of which one is or is inside the other.
+func (e *Error) CheckOverlap(path string, dirs map[string]string) {
+	keys := make([]string, 0, len(dirs))
+	cleaned := make(map[string]string, len(dirs))
+	for key, dir := range dirs {
+		keys = append(keys, key)
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		cleaned[key] = filepath.Clean(dir)
+	}
+	sort.Strings(keys)
+	inside := func(dir string, parent string) bool {
+		return dir == parent || strings.HasPrefix(dir, strings.TrimSuffix(parent, string(filepath.Separator))+string(filepath.Separator))
+	}
+	for i, a := range keys {
+		for _, b := range keys[i+1:] {
+			if inside(cleaned[a], cleaned[b]) || inside(cleaned[b], cleaned[a]) {
+				e.Problem(path, "%s at %s and %s at %s overlap", a, dirs[a], b, dirs[b])
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"github.com/elgs/filesync/index"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The same gsyncd config in each format, with a monitor given by its path
+// and one as an object.
+var serverFiles = map[string]string{
+	"gsyncd.json": `{
+    "port": 7000,
+    "shutdown_timeout": "1m",
+    "monitors": {
+        "a": "/srv/a",
+        "b": {"path": "/srv/b", "workers": 8, "write_quiet": "0s", "history": {"versions": 3}}
+    }
+}`,
+	"gsyncd.yaml": `port: 7000
+shutdown_timeout: 1m
+monitors:
+  a: /srv/a
+  b:
+    path: /srv/b
+    workers: 8
+    write_quiet: 0s
+    history:
+      versions: 3
+`,
+	"gsyncd.toml": `port = 7000
+shutdown_timeout = "1m"
+
+[monitors]
+a = "/srv/a"
+
+[monitors.b]
+path = "/srv/b"
+workers = 8
+write_quiet = "0s"
+
+[monitors.b.history]
+versions = 3
+`,
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadServer(t *testing.T) {
+	for name, content := range serverFiles {
+		t.Run(name, func(t *testing.T) {
+			s := NewServer()
+			problems, err := Load(writeFile(t, name, content), "", s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := problems.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if s.IP != "127.0.0.1" || s.Port != 7000 || time.Duration(s.ShutdownTimeout) != time.Minute {
+				t.Errorf("read %+v", s)
+			}
+			a, b := s.Monitors["a"], s.Monitors["b"]
+			if a.Path != "/srv/a" || a.Workers != index.INDEX_WORKERS || time.Duration(a.WriteQuiet) != index.WRITE_QUIET || a.History != nil {
+				t.Errorf("monitor a is %+v, want the defaults", a)
+			}
+			if b.Path != "/srv/b" || b.Workers != 8 || b.WriteQuiet != 0 || b.QueueSize != index.INDEX_QUEUE_SIZE {
+				t.Errorf("monitor b is %+v", b)
+			}
+			if b.History == nil || b.History.Versions != 3 {
+				t.Errorf("monitor b has the history %+v", b.History)
+			}
+		})
+	}
+}
+
+func TestLoadUnknown(t *testing.T) {
+	for name, content := range map[string]string{
+		"top.json":     `{"prot": 7000, "monitors": {"a": "/srv/a"}}`,
+		"monitor.json": `{"monitors": {"a": {"path": "/srv/a", "workerz": 8}}}`,
+		"type.json":    `{"port": "7000"}`,
+		"top.yaml":     "prot: 7000\n",
+		"monitor.yaml": "monitors:\n  a:\n    path: /srv/a\n    workerz: 8\n",
+		"top.toml":     "prot = 7000\n",
+		"monitor.toml": "[monitors.a]\npath = \"/srv/a\"\nworkerz = 8\n",
+		"nested.toml":  "[monitors.a]\npath = \"/srv/a\"\n[monitors.a.history]\nversionz = 3\n",
+		"bad.toml":     "shutdown_timeout = \"soon\"\n",
+	} {
+		if _, err := Load(writeFile(t, name, content), "", NewServer()); err == nil {
+			t.Errorf("%s was read", name)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("GSYNC_PORT", "7001")
+	t.Setenv("GSYNC_DELETE_BRAKE_EXIT", "true")
+	t.Setenv("GSYNC_DELETE_BRAKE_WINDOW", "10m")
+	t.Setenv("GSYNC_MONITORS_HOME_A_SNAPSHOT", "true")
+	t.Setenv("GSYNC_TRASH_DAYS", "many")
+	c := NewClient()
+	problems, err := Load(writeFile(t, "gsync.json", `{"monitors": {"home-a": "/home/a"}}`), "GSYNC", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 7001 || !c.DeleteBrake.Exit || time.Duration(c.DeleteBrake.Window) != 10*time.Minute || c.DeleteBrake.Percent != 20 {
+		t.Errorf("read %+v", c)
+	}
+	if m := c.Monitors["home-a"]; m.Path != "/home/a" || !m.Snapshot {
+		t.Errorf("monitor home-a is %+v", m)
+	}
+	err = problems.Err()
+	if err == nil || !strings.Contains(err.Error(), "trash_days") {
+		t.Fatalf("the variable of trash_days isn't a problem: %v", err)
+	}
+}
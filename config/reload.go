@@ -0,0 +1,79 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/elgs/filesync/index"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// RELOAD_QUIET is how long the config file has to be left alone after a
+// change before it is reloaded, so an editor saving it in several steps
+// reloads it once.
+const RELOAD_QUIET = time.Second
+
+// Reloads returns a channel that is sent to on SIGHUP and when configFile
+// changes, until ctx is done. Sends are dropped while one is pending.
+func Reloads(ctx context.Context, configFile string) <-chan struct{} {
+	reload := make(chan struct{}, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// the directory is watched, editors and tools replace the file by
+	// renaming another one over it
+	configPath, _ := filepath.Abs(configFile)
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	watcher, err := index.NewWatcher(index.WATCHER_AUTO, filepath.Dir(configPath), index.POLL_INTERVAL)
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(configPath)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		fmt.Println("Not watching", configFile+", reload it with SIGHUP:", err)
+	} else {
+		events, watchErrors = watcher.Events(), watcher.Errors()
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		if events != nil {
+			defer watcher.Close()
+		}
+		var quiet <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+				} else if event.Name == configPath {
+					quiet = time.After(RELOAD_QUIET)
+				}
+				continue
+			case err, ok := <-watchErrors:
+				if !ok {
+					watchErrors = nil
+				} else {
+					fmt.Println(err)
+				}
+				continue
+			case <-quiet:
+				quiet = nil
+			}
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return reload
+}
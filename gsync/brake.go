@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/elgs/filesync/client"
+	"os"
+	"path/filepath"
+)
+
+// BRAKE_EXIT_STATUS is the exit status of gsync when a brake with Exit set
+// trips.
+const BRAKE_EXIT_STATUS = 3
+
+// confirmDeletes implements "gsync confirm-deletes [-config gsync.json] <monitor>".
+// The running gsync applies the deletes held back by the brake of monitor in
+// its next cycle.
+func confirmDeletes(arguments []string) int {
+	flags := flag.NewFlagSet("confirm-deletes", flag.ContinueOnError)
+	configFile := flags.String("config", "gsync.json", "config file")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("usage: gsync confirm-deletes [-config gsync.json] <monitor>")
+		return 2
+	}
+	key := flags.Arg(0)
+	monitored, err := configuredMonitor(*configFile, key)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	confirm := client.BrakeConfirm(monitored)
+	if err := os.MkdirAll(filepath.Dir(confirm), os.FileMode(0755)); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	f, err := os.Create(confirm)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	f.Close()
+	fmt.Println("Deletes of", key, "confirmed, they are applied in the next sync.")
+	return 0
+}
@@ -1,243 +1,307 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	simplejson "github.com/bitly/go-simplejson"
+	"github.com/elgs/filesync/client"
+	cfg "github.com/elgs/filesync/config"
 	"github.com/elgs/filesync/index"
-	"hash/crc32"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 )
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(restore(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "untrash" {
+		os.Exit(untrash(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "confirm-deletes" {
+		os.Exit(confirmDeletes(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "--check-config" || os.Args[1] == "-check-config") {
+		os.Args = os.Args[1:]
+		os.Exit(checkConfig(args()[0]))
+	}
 	fmt.Println("CPUs: ", runtime.NumCPU())
 	input := args()
-	done := make(chan bool)
 	if len(input) >= 1 {
-		start(input[0], done)
+		os.Exit(start(input[0]))
 	}
-	<-done
 }
 
-func start(configFile string, done chan bool) {
-	b, err := ioutil.ReadFile(configFile)
+// start syncs the monitors of configFile until SIGINT or SIGTERM, or until a
+// brake with exit set trips, and returns the exit status: 0 once the files
+// being downloaded are done, BRAKE_EXIT_STATUS for a brake and 1 otherwise.
+// The monitors follow configFile as it is reloaded.
+func start(configFile string) int {
+	// a second signal kills right away, stop restores the default handling
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	current, err := readConfig(configFile)
 	if err != nil {
-		fmt.Println(configFile, " not found")
-		go func() {
-			done <- false
-		}()
-		return
+		fmt.Println(err)
+		return 1
 	}
-	json, _ := simplejson.NewJson(b)
-	ip := json.Get("ip").MustString("127.0.0.1")
-	port := json.Get("port").MustInt(6776)
+	monitors := current.monitors
+	reload := cfg.Reloads(ctx, configFile)
 
-	monitors := json.Get("monitors").MustMap()
+	// a brake that trips stops the other monitors too
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
-	for k, v := range monitors {
-		monitored, _ := v.(string)
-		go startWork(ip, port, k, monitored, time.Minute)
+	cache := client.NewBlockCache()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	status := 0
+	running := make(map[string]*runningMonitor)
+	run := func(key string, config monitorConfig) {
+		monitorCtx, stopMonitor := context.WithCancel(ctx)
+		m := &runningMonitor{config, stopMonitor, make(chan struct{})}
+		running[key] = m
+		syncer := config.syncer(key, cache)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(m.done)
+			err := syncer.Run(monitorCtx)
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := err.(*client.BrakeError); ok {
+				status = BRAKE_EXIT_STATUS
+				cancel(err)
+				return
+			}
+			if err != context.Canceled {
+				// such as a download cut short
+				fmt.Println(err)
+				if status == 0 {
+					status = 1
+				}
+			}
+		}()
 	}
-}
-func args() []string {
-	ret := []string{}
-	if len(os.Args) <= 1 {
-		ret = append(ret, "gsync.json")
-	} else {
-		for i := 1; i < len(os.Args); i++ {
-			ret = append(ret, os.Args[i])
-		}
+	for _, key := range sortedKeys(monitors) {
+		run(key, monitors[key])
 	}
-	return ret
-}
 
-func startWork(ip string, port int, key string, monitored string, maxInterval time.Duration) {
-	var lastIndexed int64 = 0
-	var changed bool = false
-	sleepTime := time.Second
-	for {
-		if changed {
-			sleepTime = time.Second
-		} else {
-			sleepTime *= 2
-			if sleepTime >= maxInterval {
-				sleepTime = maxInterval
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-reload:
+			next, err := readConfig(configFile)
+			if err != nil {
+				fmt.Println("Keeping the current monitors,", err)
+				continue
 			}
-		}
-		changed = false
-		//fmt.Println("Sleep", sleepTime, lastIndexed)
-		time.Sleep(sleepTime)
-		dirs := dirsFromServer(ip, port, key, lastIndexed-3600)
-		if len(dirs) > 0 {
-			for _, dir := range dirs {
-				dirMap, _ := dir.(map[string]interface{})
-				dirPath, _ := dirMap["FilePath"].(string)
-				dirStatus := dirMap["Status"].(string)
-				dir := index.PathSafe(index.SlashSuffix(monitored) + dirPath)
-				if dirStatus == "deleted" {
-					err := os.RemoveAll(dir)
-					if err != nil {
-						fmt.Println(err)
-					}
+			monitors := next.monitors
+			fmt.Println("Reloading", configFile)
+			// a monitor whose config changed is stopped before it is run
+			// again, so two syncers never write to one directory
+			for key, m := range running {
+				if config, ok := monitors[key]; ok && config == m.config {
 					continue
 				}
-				mode, _ := dirMap["FileMode"].(json.Number)
-				dirMode, _ := mode.Int64()
-				err := os.MkdirAll(dir, os.FileMode(dirMode))
-				if err != nil {
-					fmt.Println(err)
-				}
+				m.stop()
+				<-m.done
+				delete(running, key)
+				fmt.Println("Stopped monitor", key)
 			}
-
-			files := filesFromServer(ip, port, key, "/", lastIndexed-3600)
-			for _, file := range files {
-				fileMap, _ := file.(map[string]interface{})
-				filePath, _ := fileMap["FilePath"].(string)
-				fileStatus := fileMap["Status"].(string)
-				indexed, _ := fileMap["LastIndexed"].(json.Number)
-				serverIndexed, _ := indexed.Int64()
-				if serverIndexed > lastIndexed {
-					lastIndexed = serverIndexed
-				}
-
-				f := index.PathSafe(index.SlashSuffix(monitored) + filePath)
-				if fileStatus == "deleted" {
-					err := os.RemoveAll(f)
-					if err != nil {
-						fmt.Println(err)
-					}
-					continue
-				}
-				size, _ := fileMap["FileSize"].(json.Number)
-				fileSize, _ := size.Int64()
-				if info, err := os.Stat(f); os.IsNotExist(err) {
-					// file does not exists, download it
-					changed = true
-					func() {
-						out, _ := os.Create(f)
-						defer out.Close()
-						downloadFromServer(ip, port, key, filePath, 0, fileSize, out)
-					}()
-				} else {
-					// file exists, analyze it
-					modified, _ := fileMap["LastModified"].(json.Number)
-					lastModified, _ := modified.Int64()
-					if fileSize == info.Size() && lastModified < info.ModTime().Unix() {
-						// this file is probably not changed
-						continue
-					}
-					// file change, analyse it block by block
-					changed = true
-					fileParts := filePartsFromServer(ip, port, key, filePath)
-					func() {
-						out, _ := os.OpenFile(f, os.O_RDWR, os.FileMode(0666))
-						defer out.Close()
-						out.Truncate(fileSize)
-						if len(fileParts) == 0 {
-							return
-						}
-						h := crc32.NewIEEE()
-						for _, filePart := range fileParts {
-							filePartMap, _ := filePart.(map[string]interface{})
-							idx, _ := filePartMap["StartIndex"].(json.Number)
-							startIndex, _ := idx.Int64()
-							ost, _ := filePartMap["Offset"].(json.Number)
-							offset, _ := ost.Int64()
-							checksum := filePartMap["Checksum"].(string)
-
-							buf := make([]byte, offset)
-							n, _ := out.ReadAt(buf, startIndex)
-
-							h.Reset()
-							h.Write(buf[:n])
-							v := fmt.Sprint(h.Sum32())
-							if checksum == v {
-								// block unchanged
-								return
-							}
-							// block changed
-							downloadFromServer(ip, port, key, filePath, startIndex, offset, out)
-						}
-					}()
+			for _, key := range sortedKeys(monitors) {
+				if _, ok := running[key]; !ok && ctx.Err() == nil {
+					run(key, monitors[key])
+					fmt.Println("Started monitor", key)
 				}
 			}
 		}
 	}
+	stop()
+	fmt.Println("Shutting down, waiting for downloads in progress")
+	wg.Wait()
+	if status == 0 {
+		fmt.Println("Stopped")
+	}
+	return status
 }
 
-func downloadFromServer(ip string, port int, key string, filePath string, start int64, length int64, file *os.File) int64 {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
-		}
-	}()
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", fmt.Sprint("http://", ip, ":", port,
-		"/download?&file_path=", url.QueryEscape(filePath), "&start=", start, "&length=", length), nil)
-	req.Header.Add("AUTH_KEY", key)
-	resp, _ := client.Do(req)
-	defer resp.Body.Close()
-	file.Seek(start, os.SEEK_SET)
-	n, _ := io.CopyN(file, resp.Body, length)
-	return n
+// runningMonitor is a monitor being synced by start.
+type runningMonitor struct {
+	config monitorConfig
+	stop   context.CancelFunc
+	// done is closed once its syncer returned
+	done chan struct{}
 }
 
-func filePartsFromServer(ip string, port int, key string, filePath string) []interface{} {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
+// monitorConfig is what gsync.json sets for a monitor, the settings that
+// apply to every monitor included.
+type monitorConfig struct {
+	ip        string
+	port      int
+	monitored string
+	snapshot  bool
+	keepTrash time.Duration
+	brake     client.DeleteBrake
+	stopGrace time.Duration
+}
+
+// syncer returns the syncer of the monitor key.
+func (config monitorConfig) syncer(key string, cache *client.BlockCache) interface {
+	Run(ctx context.Context) error
+} {
+	if config.snapshot {
+		return &client.SnapshotSyncer{
+			Client:      client.New(config.ip, config.port, key),
+			Monitored:   index.PathSafe(config.monitored),
+			MaxInterval: time.Minute,
+			Brake:       config.brake,
 		}
-	}()
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", fmt.Sprint("http://", ip, ":", port,
-		"/file_parts?file_path=", url.QueryEscape(filePath)), nil)
-	req.Header.Add("AUTH_KEY", key)
-	resp, _ := client.Do(req)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	json, _ := simplejson.NewJson(body)
-	fileParts := json.MustArray()
-	return fileParts
+	}
+	return &client.Syncer{
+		Client:      client.New(config.ip, config.port, key),
+		Monitored:   config.monitored,
+		MaxInterval: time.Minute,
+		KeepTrash:   config.keepTrash,
+		Brake:       config.brake,
+		Cache:       cache,
+		StopGrace:   config.stopGrace,
+	}
 }
 
-func filesFromServer(ip string, port int, key string, filePath string, lastIndexed int64) []interface{} {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
+// config is what gsync.json sets.
+type config struct {
+	// defaults holds the settings that apply to every monitor
+	defaults monitorConfig
+	monitors map[string]monitorConfig
+}
+
+// readConfig returns the settings of configFile, an error listing every
+// problem with them if there are any.
+func readConfig(configFile string) (*config, error) {
+	file := cfg.NewClient()
+	problems, err := cfg.Load(configFile, "GSYNC", file)
+	if err != nil {
+		return nil, err
+	}
+	c := &config{
+		defaults: monitorConfig{
+			ip:        file.IP,
+			port:      file.Port,
+			keepTrash: time.Duration(file.TrashDays) * 24 * time.Hour,
+			brake: client.DeleteBrake{
+				Percent: file.DeleteBrake.Percent,
+				Count:   file.DeleteBrake.Count,
+				Window:  time.Duration(file.DeleteBrake.Window),
+				Exit:    file.DeleteBrake.Exit,
+			},
+			stopGrace: time.Duration(file.ShutdownTimeout),
+		},
+		monitors: make(map[string]monitorConfig),
+	}
+	if c.defaults.ip == "" {
+		problems.Problem("ip", "no server is set")
+	}
+	if c.defaults.port < 1 || c.defaults.port > 65535 {
+		problems.Problem("port", "%d is not a port", c.defaults.port)
+	}
+	if c.defaults.keepTrash < 0 {
+		problems.Problem("trash_days", "can't be negative")
+	}
+	if c.defaults.brake.Percent < 0 || c.defaults.brake.Percent > 100 {
+		problems.Problem("delete_brake.percent", "%d is not between 0 and 100", c.defaults.brake.Percent)
+	}
+	if c.defaults.brake.Count < 0 {
+		problems.Problem("delete_brake.count", "can't be negative")
+	}
+	if c.defaults.brake.Window <= 0 {
+		problems.Problem("delete_brake.window", "has to be positive")
+	}
+
+	keys := make([]string, 0, len(file.Monitors))
+	for k := range file.Monitors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	dirs := make(map[string]string)
+	for _, k := range keys {
+		config := c.defaults
+		config.monitored = file.Monitors[k].Path
+		config.snapshot = file.Monitors[k].Snapshot
+		c.monitors[k] = config
+
+		// the directory itself is created by the first sync
+		path := "monitors." + k
+		if config.monitored == "" {
+			problems.Problem(path, "no path is set")
+		} else if info, err := os.Stat(config.monitored); err == nil && !info.IsDir() {
+			problems.Problem(path+".path", "%s is not a directory", config.monitored)
+		} else if _, err := os.Stat(filepath.Dir(filepath.Clean(config.monitored))); err != nil {
+			problems.Problem(path+".path", "%v", err)
+		} else {
+			dirs[k] = config.monitored
 		}
-	}()
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", fmt.Sprint("http://", ip, ":", port,
-		"/files?last_indexed=", lastIndexed, "&file_path=", url.QueryEscape(filePath)), nil)
-	req.Header.Add("AUTH_KEY", key)
-	resp, _ := client.Do(req)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	json, _ := simplejson.NewJson(body)
-	files := json.MustArray()
-	return files
+	}
+	if len(c.monitors) == 0 {
+		problems.Problem("monitors", "no monitors are set")
+	}
+	problems.CheckOverlap("monitors", dirs)
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-func dirsFromServer(ip string, port int, key string, lastIndexed int64) []interface{} {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
+// checkConfig implements "gsync --check-config [gsync.json]". It reports
+// every problem with the config file and returns the exit status.
+func checkConfig(configFile string) int {
+	if _, err := readConfig(configFile); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(configFile, "is valid")
+	return 0
+}
+
+// sortedKeys returns the keys of monitors, sorted.
+func sortedKeys(monitors map[string]monitorConfig) []string {
+	keys := make([]string, 0, len(monitors))
+	for key := range monitors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func args() []string {
+	ret := []string{}
+	if len(os.Args) <= 1 {
+		ret = append(ret, "gsync.json")
+	} else {
+		for i := 1; i < len(os.Args); i++ {
+			ret = append(ret, os.Args[i])
 		}
-	}()
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", fmt.Sprint("http://", ip, ":", port, "/dirs?last_indexed=", lastIndexed), nil)
-	req.Header.Add("AUTH_KEY", key)
-	resp, _ := client.Do(req)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	json, _ := simplejson.NewJson(body)
-	dirs := json.MustArray()
-	return dirs
+	}
+	return ret
+}
+
+// configuredMonitor returns the local directory of the monitor key in
+// configFile.
+func configuredMonitor(configFile string, key string) (string, error) {
+	c, err := readConfig(configFile)
+	if err != nil {
+		return "", err
+	}
+	monitor, ok := c.monitors[key]
+	if !ok {
+		return "", fmt.Errorf("unknown monitor %s", key)
+	}
+	return index.PathSafe(monitor.monitored), nil
 }
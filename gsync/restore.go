@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/elgs/filesync/client"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// restore implements "gsync restore [-config gsync.json] [-at time] [-to dir] <monitor> <path>".
+// It writes the file or directory path of monitor, as it was on the server
+// at the given time, into dir and returns the exit status.
+func restore(arguments []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	configFile := flags.String("config", "gsync.json", "config file")
+	at := flags.String("at", "", "time to restore, 2006-01-02 15:04:05 in local time or RFC3339, now if empty")
+	to := flags.String("to", ".", "directory the restored files are written to")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		fmt.Println("usage: gsync restore [-config gsync.json] [-at time] [-to dir] <monitor> <path>")
+		return 2
+	}
+	key, filePath := flags.Arg(0), path.Clean("/"+flags.Arg(1))
+
+	restoreTime := time.Now()
+	if *at != "" {
+		var err error
+		if restoreTime, err = time.ParseInLocation("2006-01-02 15:04:05", *at, time.Local); err != nil {
+			if restoreTime, err = time.Parse(time.RFC3339, *at); err != nil {
+				fmt.Println("Invalid time", *at)
+				return 2
+			}
+		}
+	}
+
+	config, err := readConfig(*configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	c := client.New(config.defaults.ip, config.defaults.port, key)
+	ctx := context.Background()
+	versions, err := c.Snapshot(ctx, filePath, restoreTime.Unix())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if len(versions) == 0 {
+		fmt.Println("Nothing to restore at", filePath, "as of", restoreTime.Format("2006-01-02 15:04:05"))
+		return 1
+	}
+	failed := 0
+	for _, version := range versions {
+		target := filepath.Join(*to, filepath.FromSlash(version.FilePath))
+		if err := c.RestoreVersion(ctx, version, target); err != nil {
+			fmt.Println("Failed to restore", version.FilePath, err)
+			failed++
+			continue
+		}
+		fmt.Println("Restored", version.FilePath, "as of", time.Unix(version.VersionTime, 0).Format("2006-01-02 15:04:05"), "to", target)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
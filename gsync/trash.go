@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/elgs/filesync/client"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// untrash implements "gsync untrash [-config gsync.json] [-to dir] <monitor> [path]".
+// Without a path it lists the trash of monitor. With one it moves the most
+// recently deleted copy of path back, to where it was or into dir, and
+// returns the exit status.
+func untrash(arguments []string) int {
+	flags := flag.NewFlagSet("untrash", flag.ContinueOnError)
+	configFile := flags.String("config", "gsync.json", "config file")
+	to := flags.String("to", "", "directory to restore into instead of the monitored directory")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		fmt.Println("usage: gsync untrash [-config gsync.json] [-to dir] <monitor> [path]")
+		return 2
+	}
+	monitored, err := configuredMonitor(*configFile, flags.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	names, times := client.TrashEntries(monitored)
+
+	if flags.NArg() == 1 {
+		for _, name := range names {
+			root := filepath.Join(monitored, client.TRASH_DIR, name)
+			filepath.Walk(root, func(thePath string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					rel, _ := filepath.Rel(root, thePath)
+					fmt.Println(times[name].Format("2006-01-02 15:04:05"), "/"+filepath.ToSlash(rel))
+				}
+				return nil
+			})
+		}
+		return 0
+	}
+
+	rel := filepath.FromSlash(path.Clean("/" + flags.Arg(1))[1:])
+	if rel == "" {
+		fmt.Println("Nothing to restore at /")
+		return 1
+	}
+	target := filepath.Join(monitored, rel)
+	if *to != "" {
+		target = filepath.Join(*to, rel)
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		from := filepath.Join(monitored, client.TRASH_DIR, names[i], rel)
+		if _, err := os.Lstat(from); err != nil {
+			continue
+		}
+		if _, err := os.Lstat(target); err == nil {
+			fmt.Println(target, "already exists")
+			return 1
+		}
+		os.MkdirAll(filepath.Dir(target), os.FileMode(0755))
+		if err := os.Rename(from, target); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if *to == "" {
+			// restored in place, the syncer leaves it there
+			if err := client.MarkRestored(monitored, names[i], rel); err != nil {
+				fmt.Println(err)
+				return 1
+			}
+		}
+		fmt.Println("Restored", target, "deleted", times[names[i]].Format("2006-01-02 15:04:05"))
+		return 0
+	}
+	fmt.Println("/"+filepath.ToSlash(rel), "is not in the trash")
+	return 1
+}
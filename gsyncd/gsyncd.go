@@ -1,54 +1,244 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
-	simplejson "github.com/bitly/go-simplejson"
-	"github.com/elgs/filesync/api"
+	cfg "github.com/elgs/filesync/config"
 	"github.com/elgs/filesync/index"
-	"github.com/fsnotify/fsnotify"
-	_ "github.com/mattn/go-sqlite3"
-	"io/ioutil"
+	"github.com/elgs/filesync/server"
+	"net"
 	"os"
+	"os/signal"
+	"reflect"
 	"runtime"
+	"sort"
+	"syscall"
+	"time"
 )
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	if len(os.Args) > 1 && (os.Args[1] == "--check-config" || os.Args[1] == "-check-config") {
+		os.Args = os.Args[1:]
+		os.Exit(checkConfig(args()[0]))
+	}
 	fmt.Println("CPUs: ", runtime.NumCPU())
 
 	input := args()
 	if len(input) >= 1 {
-		start(input[0])
+		os.Exit(start(input[0]))
+	}
+}
+
+// start serves the monitors of configFile until SIGINT or SIGTERM, and
+// returns the exit status: 0 once everything in progress is done, 1 if the
+// server couldn't start or the shutdown timed out. The monitors follow
+// configFile as it is reloaded.
+func start(configFile string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// a second signal kills right away, even while a directory is being
+	// scanned, as stop restores the default handling
+	context.AfterFunc(ctx, stop)
+
+	current, err := readConfig(configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	reload := cfg.Reloads(ctx, configFile)
+	srv := server.New(current.options)
+	served := make(map[string]server.MonitorOptions)
+	update(ctx, srv, served, current.monitors, current.shutdownTimeout)
+
+	if err := srv.Start(); err != nil {
+		fmt.Println(err)
+		srv.Shutdown(context.Background())
+		return 1
+	}
+
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-reload:
+			next, err := readConfig(configFile)
+			if err != nil {
+				fmt.Println("Keeping the current monitors,", err)
+				continue
+			}
+			fmt.Println("Reloading", configFile)
+			if next.options != current.options {
+				fmt.Println("ip, port and index_store take effect on restart")
+			}
+			current.shutdownTimeout = next.shutdownTimeout
+			update(ctx, srv, served, next.monitors, current.shutdownTimeout)
+		}
+	}
+	fmt.Println("Shutting down, waiting up to", current.shutdownTimeout, "for downloads and indexing in progress")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), current.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Println(err)
+		return 1
 	}
+	fmt.Println("Stopped")
+	return 0
 }
 
-func start(configFile string) {
-	b, err := ioutil.ReadFile(configFile)
+// config is what gsyncd.json sets.
+type config struct {
+	options         server.Options
+	shutdownTimeout time.Duration
+	monitors        map[string]server.MonitorOptions
+}
+
+// readConfig returns the settings of configFile, an error listing every
+// problem with them if there are any.
+func readConfig(configFile string) (*config, error) {
+	file := cfg.NewServer()
+	problems, err := cfg.Load(configFile, "GSYNCD", file)
 	if err != nil {
-		fmt.Println(configFile, " not found")
-		return
+		return nil, err
+	}
+	c := &config{
+		options: server.Options{
+			IP:         file.IP,
+			Port:       file.Port,
+			IndexStore: file.IndexStore,
+		},
+		shutdownTimeout: time.Duration(file.ShutdownTimeout),
+		monitors:        make(map[string]server.MonitorOptions),
+	}
+	if net.ParseIP(c.options.IP) == nil {
+		problems.Problem("ip", "%q is not an ip address", c.options.IP)
+	}
+	if c.options.Port < 1 || c.options.Port > 65535 {
+		problems.Problem("port", "%d is not a port", c.options.Port)
+	}
+	switch c.options.IndexStore {
+	case "", "sqlite", "memory":
+	default:
+		problems.Problem("index_store", "%q is neither sqlite nor memory", c.options.IndexStore)
+	}
+
+	keys := make([]string, 0, len(file.Monitors))
+	for k := range file.Monitors {
+		keys = append(keys, k)
 	}
-	json, _ := simplejson.NewJson(b)
-	ip := json.Get("ip").MustString("127.0.0.1")
-	port := json.Get("port").MustInt(6776)
+	sort.Strings(keys)
+	dirs := make(map[string]string)
+	for _, k := range keys {
+		monitor := file.Monitors[k]
+		path := "monitors." + k
+		options := server.MonitorOptions{
+			Path:           monitor.Path,
+			IndexPath:      monitor.IndexPath,
+			BlockStore:     monitor.BlockStore,
+			WriteQuiet:     time.Duration(monitor.WriteQuiet),
+			WriteMaxWait:   time.Duration(monitor.WriteMaxWait),
+			Workers:        monitor.Workers,
+			QueueSize:      monitor.QueueSize,
+			PatrolInterval: time.Duration(monitor.PatrolInterval),
+			PatrolBatch:    monitor.PatrolBatch,
+			Watcher:        monitor.Watcher,
+			PollInterval:   time.Duration(monitor.PollInterval),
+		}
+		if monitor.History != nil {
+			options.History = &index.History{
+				Versions: monitor.History.Versions,
+				Days:     monitor.History.Days,
+			}
+			if options.History.Versions < 0 || options.History.Days < 0 {
+				problems.Problem(path+".history", "versions and days can't be negative")
+			}
+		}
 
-	monitors := json.Get("monitors").MustMap()
+		if info, err := os.Stat(options.Path); options.Path == "" {
+			problems.Problem(path, "no path is set")
+		} else if err != nil {
+			problems.Problem(path+".path", "%v", err)
+		} else if !info.IsDir() {
+			problems.Problem(path+".path", "%s is not a directory", options.Path)
+		} else {
+			dirs[k] = options.Path
+		}
+		switch options.Watcher {
+		case index.WATCHER_AUTO, index.WATCHER_FSNOTIFY, index.WATCHER_POLL:
+		default:
+			problems.Problem(path+".watcher", "%q is not %s, %s or %s", options.Watcher, index.WATCHER_AUTO, index.WATCHER_FSNOTIFY, index.WATCHER_POLL)
+		}
+		if options.Workers < 1 {
+			problems.Problem(path+".workers", "at least 1 worker is needed")
+		}
+		if options.QueueSize < 1 {
+			problems.Problem(path+".queue_size", "the queue needs room for at least 1 file")
+		}
+		if options.PatrolBatch < 1 {
+			problems.Problem(path+".patrol_batch", "a patrol looks at 1 entry at least")
+		}
+		c.monitors[k] = options
+	}
+	if len(c.monitors) == 0 {
+		problems.Problem("monitors", "no monitors are set")
+	}
+	problems.CheckOverlap("monitors", dirs)
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-	for _, v := range monitors {
-		watcher, _ := fsnotify.NewWatcher()
-		monitored, _ := v.(string)
-		monitored = index.PathSafe(monitored)
-		db, _ := sql.Open("sqlite3", index.SlashSuffix(monitored)+".sync/index.db")
-		defer db.Close()
-		db.Exec("VACUUM;")
-		index.InitIndex(monitored, db)
-		index.WatchRecursively(watcher, monitored, monitored)
-		go index.ProcessEvent(watcher, monitored)
+// checkConfig implements "gsyncd --check-config [gsyncd.json]". It reports
+// every problem with the config file and returns the exit status.
+func checkConfig(configFile string) int {
+	if _, err := readConfig(configFile); err != nil {
+		fmt.Println(err)
+		return 1
 	}
+	fmt.Println(configFile, "is valid")
+	return 0
+}
 
-	api.RunWeb(ip, port, monitors)
-	//watcher.Close()
+// update brings the monitors of srv, whose options are kept in served, in
+// line with monitors. Monitors whose options are the same keep being served
+// as they are, the others are removed and added again. A monitor that fails
+// to be added is left out of served, so the next update tries again. No
+// monitor is added once ctx is done, the scan of each would hold up the
+// shutdown. A monitor being removed gets timeout to finish its downloads and
+// indexing, less if ctx is done first.
+func update(ctx context.Context, srv *server.Server, served map[string]server.MonitorOptions, monitors map[string]server.MonitorOptions, timeout time.Duration) {
+	for key, options := range served {
+		if next, ok := monitors[key]; ok && reflect.DeepEqual(next, options) {
+			continue
+		}
+		removeCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := srv.RemoveMonitor(removeCtx, key)
+		cancel()
+		if err != nil {
+			fmt.Println(err)
+		}
+		delete(served, key)
+		fmt.Println("Removed monitor", key)
+	}
+	keys := make([]string, 0, len(monitors))
+	for key := range monitors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := served[key]; ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := srv.AddMonitor(key, monitors[key]); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		served[key] = monitors[key]
+		fmt.Println("Added monitor", key)
+	}
 }
 
 func args() []string {
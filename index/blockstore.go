@@ -0,0 +1,142 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// BLOCK_GRACE is how long an unreferenced block is kept before Collect
+// removes it, so a block whose part hasn't been committed yet survives.
+const BLOCK_GRACE = time.Hour
+
+var blockHash = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// BlockStore keeps the content of indexed parts as immutable files named by
+// their StrongChecksum, <dir>/ab/abcdef..., so a block shared by several
+// files is stored once. A block stays readable by its hash after the file
+// it came from changed, which is what history and snapshots build on.
+type BlockStore struct {
+	dir string
+}
+
+// OpenBlockStore opens the block store in dir, creating it if needed.
+func OpenBlockStore(dir string) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, (os.FileMode)(0755)); err != nil {
+		return nil, err
+	}
+	return &BlockStore{dir: dir}, nil
+}
+
+// Path returns where the block hash is kept, or "" if hash isn't a
+// hex encoded sha256.
+func (blocks *BlockStore) Path(hash string) string {
+	if !blockHash.MatchString(hash) {
+		return ""
+	}
+	return filepath.Join(blocks.dir, hash[:2], hash)
+}
+
+// Put stores data as the block hash. A block that is already there isn't
+// written again, but its mtime is refreshed so Collect leaves it alone
+// until the part referencing it is committed.
+func (blocks *BlockStore) Put(hash string, data []byte) error {
+	blockPath := blocks.Path(hash)
+	if blockPath == "" {
+		return fmt.Errorf("invalid block hash %q", hash)
+	}
+	now := time.Now()
+	if err := os.Chtimes(blockPath, now, now); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blockPath), (os.FileMode)(0755)); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(blockPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), blockPath)
+}
+
+// Open opens the block hash for reading.
+func (blocks *BlockStore) Open(hash string) (*os.File, error) {
+	blockPath := blocks.Path(hash)
+	if blockPath == "" {
+		return nil, fmt.Errorf("invalid block hash %q", hash)
+	}
+	return os.Open(blockPath)
+}
+
+// Collect removes the blocks no part in store references any more, once
+// they are older than BLOCK_GRACE. It returns the number of blocks removed.
+func (blocks *BlockStore) Collect(store IndexStore) (int, error) {
+	refs, err := store.BlockRefs()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	expired := time.Now().Add(-BLOCK_GRACE)
+	err = filepath.Walk(blocks.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if refs[info.Name()] > 0 || info.ModTime().After(expired) {
+			return nil
+		}
+		if err := os.Remove(path); err == nil && blockHash.MatchString(info.Name()) {
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// hasBlocks reports whether every part of filePath is in the block store,
+// always true if the monitor doesn't keep one.
+func (m *Monitor) hasBlocks(tx IndexTx, filePath string) bool {
+	if m.Blocks == nil {
+		return true
+	}
+	parts, err := tx.FileParts(filePath)
+	if err != nil {
+		return false
+	}
+	for _, part := range parts {
+		if part.ChecksumType == HOLE {
+			continue
+		}
+		if !exists(m.Blocks.Path(part.StrongChecksum)) {
+			return false
+		}
+	}
+	return true
+}
+
+// collect drops the versions past the retention of m, then the blocks
+// nothing references any more.
+func (m *Monitor) collect() {
+	if err := m.pruneHistory(); err != nil {
+		fmt.Println(err)
+	}
+	if m.Blocks == nil {
+		return
+	}
+	removed, err := m.Blocks.Collect(m.Store)
+	if err != nil {
+		fmt.Println(err)
+	} else if removed > 0 {
+		fmt.Println("Removed", removed, "unreferenced blocks of", m.Monitored)
+	}
+}
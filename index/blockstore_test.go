@@ -0,0 +1,61 @@
+package index
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func putBlock(t *testing.T, blocks *BlockStore, data string) string {
+	sum := sha256.Sum256([]byte(data))
+	hash := hex.EncodeToString(sum[:])
+	if err := blocks.Put(hash, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestBlockStoreCollect(t *testing.T) {
+	blocks, err := OpenBlockStore(filepath.Join(t.TempDir(), "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	defer store.Close()
+	referenced := putBlock(t, blocks, "referenced")
+	fresh := putBlock(t, blocks, "fresh")
+	expired := putBlock(t, blocks, "expired")
+	refreshed := putBlock(t, blocks, "refreshed")
+	tx, _ := store.Begin()
+	tx.PutFilePart(IndexedFilePart{FilePath: "/a", Offset: 10, StrongChecksum: referenced})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * BLOCK_GRACE)
+	for _, hash := range []string{referenced, expired, refreshed} {
+		os.Chtimes(blocks.Path(hash), old, old)
+	}
+	// put again, as by a part not committed yet
+	putBlock(t, blocks, "refreshed")
+
+	removed, err := blocks.Collect(store)
+	if err != nil || removed != 1 {
+		t.Fatalf("Collect removed %d blocks: %v", removed, err)
+	}
+	for hash, kept := range map[string]bool{referenced: true, fresh: true, expired: false, refreshed: true} {
+		if exists(blocks.Path(hash)) != kept {
+			t.Errorf("block %s kept %v, want %v", hash, !kept, kept)
+		}
+	}
+	f, err := blocks.Open(referenced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if blocks.Path("../x") != "" {
+		t.Error("a path that isn't a block hash has a block")
+	}
+}
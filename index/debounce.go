@@ -0,0 +1,118 @@
+package index
+
+import (
+	"strings"
+	"time"
+)
+
+// WRITE_QUIET and WRITE_MAX_WAIT are the defaults for Monitor.WriteQuiet and
+// Monitor.WriteMaxWait.
+const (
+	WRITE_QUIET    = time.Second
+	WRITE_MAX_WAIT = time.Minute
+)
+
+// Clock is the time source of a debouncer, tests can drive it by hand.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// debouncer coalesces the writes to each path. A path is due once it has had
+// no writes for quiet, or at the latest maxWait after its first pending
+// write, so a file being written continuously is still indexed now and then.
+type debouncer struct {
+	quiet   time.Duration
+	maxWait time.Duration
+	clock   Clock
+	pending map[string]pendingWrite
+}
+
+type pendingWrite struct {
+	first time.Time
+	last  time.Time
+}
+
+// newDebouncer returns a debouncer using clock, the real one if nil.
+func newDebouncer(quiet time.Duration, maxWait time.Duration, clock Clock) *debouncer {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &debouncer{
+		quiet:   quiet,
+		maxWait: maxWait,
+		clock:   clock,
+		pending: make(map[string]pendingWrite),
+	}
+}
+
+// add records a write to thePath. It reports false if writes aren't
+// debounced, the caller indexes thePath right away then.
+func (d *debouncer) add(thePath string) bool {
+	if d.quiet <= 0 {
+		return false
+	}
+	now := d.clock.Now()
+	write, ok := d.pending[thePath]
+	if !ok {
+		write.first = now
+	}
+	write.last = now
+	d.pending[thePath] = write
+	return true
+}
+
+// remove forgets the pending writes to thePath and everything below it.
+func (d *debouncer) remove(thePath string) {
+	delete(d.pending, thePath)
+	for p := range d.pending {
+		if strings.HasPrefix(p, SlashSuffix(thePath)) {
+			delete(d.pending, p)
+		}
+	}
+}
+
+func (d *debouncer) deadline(write pendingWrite) time.Time {
+	deadline := write.last.Add(d.quiet)
+	if d.maxWait > 0 && write.first.Add(d.maxWait).Before(deadline) {
+		deadline = write.first.Add(d.maxWait)
+	}
+	return deadline
+}
+
+// due removes and returns the paths whose deadline has passed at now.
+func (d *debouncer) due(now time.Time) []string {
+	result := make([]string, 0)
+	for p, write := range d.pending {
+		if !now.Before(d.deadline(write)) {
+			result = append(result, p)
+			delete(d.pending, p)
+		}
+	}
+	return result
+}
+
+// timer returns a channel that fires at the earliest deadline, or nil if
+// nothing is pending.
+func (d *debouncer) timer() <-chan time.Time {
+	var next time.Time
+	for _, write := range d.pending {
+		if deadline := d.deadline(write); next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return d.clock.After(next.Sub(d.clock.Now()))
+}
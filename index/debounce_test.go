@@ -0,0 +1,173 @@
+package index
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced, the channels of After fire then.
+type fakeClock struct {
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	waiter := fakeWaiter{c.now.Add(d), make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, waiter)
+	return waiter.c
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			waiters = append(waiters, waiter)
+			continue
+		}
+		waiter.c <- c.now
+	}
+	c.waiters = waiters
+}
+
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func sorted(paths []string) []string {
+	sort.Strings(paths)
+	return paths
+}
+
+func TestDebounceQuiet(t *testing.T) {
+	clock := newFakeClock()
+	d := newDebouncer(time.Second, time.Minute, clock)
+	if d.timer() != nil {
+		t.Fatal("a timer is set with nothing pending")
+	}
+	if !d.add("/a.txt") {
+		t.Fatal("a write isn't debounced")
+	}
+	timer := d.timer()
+	clock.advance(999 * time.Millisecond)
+	if fired(timer) {
+		t.Fatal("the timer fired before the quiet period")
+	}
+	if due := d.due(clock.Now()); len(due) != 0 {
+		t.Fatalf("due before the quiet period: %v", due)
+	}
+	clock.advance(time.Millisecond)
+	if !fired(timer) {
+		t.Fatal("the timer didn't fire after the quiet period")
+	}
+	if due := d.due(clock.Now()); len(due) != 1 || due[0] != "/a.txt" {
+		t.Fatalf("due after the quiet period: %v, want /a.txt", due)
+	}
+	if due := d.due(clock.Now()); len(due) != 0 {
+		t.Fatalf("a path is due twice: %v", due)
+	}
+}
+
+func TestDebounceCoalesce(t *testing.T) {
+	clock := newFakeClock()
+	d := newDebouncer(time.Second, time.Minute, clock)
+	// each write restarts the quiet period, the writes are due once
+	for i := 0; i < 5; i++ {
+		d.add("/a.txt")
+		clock.advance(500 * time.Millisecond)
+	}
+	d.add("/b.txt")
+	if due := d.due(clock.Now()); len(due) != 0 {
+		t.Fatalf("due while being written: %v", due)
+	}
+	clock.advance(500 * time.Millisecond)
+	if due := d.due(clock.Now()); len(due) != 1 || due[0] != "/a.txt" {
+		t.Fatalf("due = %v, want /a.txt once", due)
+	}
+	clock.advance(500 * time.Millisecond)
+	if due := d.due(clock.Now()); len(due) != 1 || due[0] != "/b.txt" {
+		t.Fatalf("due = %v, want /b.txt", due)
+	}
+}
+
+func TestDebounceMaxWait(t *testing.T) {
+	clock := newFakeClock()
+	d := newDebouncer(time.Second, 5*time.Second, clock)
+	d.add("/log.txt")
+	// written more often than the quiet period, it is due at maxWait
+	for i := 0; i < 9; i++ {
+		clock.advance(500 * time.Millisecond)
+		d.add("/log.txt")
+	}
+	if due := d.due(clock.Now()); len(due) != 0 {
+		t.Fatalf("due before maxWait: %v", due)
+	}
+	timer := d.timer()
+	clock.advance(500 * time.Millisecond)
+	if !fired(timer) {
+		t.Fatal("the timer didn't fire at maxWait")
+	}
+	if due := d.due(clock.Now()); len(due) != 1 {
+		t.Fatalf("due at maxWait: %v, want /log.txt", due)
+	}
+	// the next write starts a new wait
+	d.add("/log.txt")
+	clock.advance(500 * time.Millisecond)
+	if due := d.due(clock.Now()); len(due) != 0 {
+		t.Fatalf("due right after the previous wait: %v", due)
+	}
+
+	// without maxWait only the quiet period counts
+	d = newDebouncer(time.Second, 0, clock)
+	d.add("/log.txt")
+	for i := 0; i < 20; i++ {
+		clock.advance(500 * time.Millisecond)
+		d.add("/log.txt")
+	}
+	if due := d.due(clock.Now()); len(due) != 0 {
+		t.Fatalf("due without maxWait: %v", due)
+	}
+}
+
+func TestDebounceRemove(t *testing.T) {
+	clock := newFakeClock()
+	d := newDebouncer(time.Second, time.Minute, clock)
+	for _, p := range []string{"/dir/a.txt", "/dir/sub/b.txt", "/dirx.txt", "/c.txt"} {
+		d.add(p)
+	}
+	d.remove("/dir")
+	d.remove("/c.txt")
+	clock.advance(time.Second)
+	if due := sorted(d.due(clock.Now())); len(due) != 1 || due[0] != "/dirx.txt" {
+		t.Fatalf("due after remove: %v, want /dirx.txt", due)
+	}
+	if d.timer() != nil {
+		t.Fatal("a timer is set with nothing pending")
+	}
+}
+
+func TestDebounceOff(t *testing.T) {
+	d := newDebouncer(0, time.Minute, newFakeClock())
+	if d.add("/a.txt") {
+		t.Fatal("a write is debounced without a quiet period")
+	}
+}
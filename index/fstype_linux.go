@@ -0,0 +1,27 @@
+package index
+
+import (
+	"syscall"
+)
+
+// remoteFSTypes are the filesystems whose changes inotify may not see, by
+// their statfs magic number.
+var remoteFSTypes = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+}
+
+// remoteFS returns the type of the filesystem holding dir if changes to it
+// can be made without inotify seeing them, "" otherwise.
+func remoteFS(dir string) string {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return ""
+	}
+	return remoteFSTypes[uint32(st.Type)]
+}
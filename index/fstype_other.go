@@ -0,0 +1,9 @@
+//go:build !linux
+
+package index
+
+// remoteFS can't tell the filesystem type here, fsnotify is used and the
+// watcher falls back to polling when it fails.
+func remoteFS(dir string) string {
+	return ""
+}
@@ -0,0 +1,48 @@
+package index
+
+import (
+	"time"
+)
+
+// GENERATION_QUIET is how long a monitor with history has to go without
+// changes before its state becomes a new generation.
+const GENERATION_QUIET = 2 * time.Second
+
+// Generation is a numbered, consistent state of a monitor: the versions of
+// its files as of Time, as returned by IndexStore.VersionsAt. Generations
+// are only taken after GENERATION_QUIET without changes, so none of them
+// holds half of an update. Clients that sync whole generations need the
+// monitor to keep history long enough to download the latest one.
+type Generation struct {
+	Seq  int64
+	Time int64
+}
+
+// newGeneration records the current state of m as the next generation. It
+// must only be called once m has been quiet for GENERATION_QUIET, nothing
+// has been recorded in the second before now then.
+func (m *Monitor) newGeneration() error {
+	if m.History == nil {
+		return nil
+	}
+	last, err := m.Store.Generation()
+	if err != nil {
+		return err
+	}
+	generation := Generation{Seq: last.Seq + 1, Time: time.Now().Unix() - 1}
+	if generation.Time <= last.Time {
+		return nil
+	}
+	return inTx(m.Store, func(tx IndexTx) error {
+		return tx.PutGeneration(generation)
+	})
+}
+
+// quietTimer returns a channel that fires after GENERATION_QUIET, or nil if
+// m takes no generations.
+func (m *Monitor) quietTimer() <-chan time.Time {
+	if m.History == nil {
+		return nil
+	}
+	return time.After(GENERATION_QUIET)
+}
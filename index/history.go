@@ -0,0 +1,98 @@
+package index
+
+import (
+	"math"
+	"os"
+	"time"
+)
+
+// FileVersion is the state of a file as of VersionTime. A version is
+// recorded whenever the content of a file changes, when it moves and when it
+// is deleted, in which case Status is "deleted". The parts of a version
+// refer to blocks in the block store by their StrongChecksum.
+type FileVersion struct {
+	FilePath     string
+	VersionTime  int64
+	LastModified int64
+	FileSize     int64
+	FileMode     os.FileMode
+	Status       string
+	FileHash     string
+}
+
+// History is how long a monitor keeps old versions: a version stays while
+// it is one of the Versions newest of its file, or younger than Days. The
+// newest version of a file is always kept.
+type History struct {
+	Versions int
+	Days     int
+}
+
+// limits returns the number of newest versions kept per file and the time
+// before which other versions are dropped.
+func (history *History) limits() (int, int64) {
+	keep := history.Versions
+	if keep < 1 {
+		keep = 1
+	}
+	var before int64 = math.MaxInt64
+	if history.Days > 0 {
+		before = time.Now().Add(-time.Duration(history.Days) * 24 * time.Hour).Unix()
+	}
+	return keep, before
+}
+
+// recordVersion adds the state of file to the history of m, unless m keeps
+// no history or the newest version already has the same status and content.
+func (m *Monitor) recordVersion(tx IndexTx, file IndexedFile, parts []IndexedFilePart) error {
+	if m.History == nil || file.FileSize < 0 {
+		return nil
+	}
+	if file.Status == "deleted" {
+		file.FileHash, parts = "", nil
+	}
+	versions, err := tx.Versions(file.FilePath)
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 && versions[0].Status == file.Status && versions[0].FileHash == file.FileHash {
+		return nil
+	}
+	err = tx.PutVersion(FileVersion{
+		FilePath:     file.FilePath,
+		VersionTime:  time.Now().Unix(),
+		LastModified: file.LastModified,
+		FileSize:     file.FileSize,
+		FileMode:     file.FileMode,
+		Status:       file.Status,
+		FileHash:     file.FileHash,
+	}, parts)
+	if err != nil {
+		return err
+	}
+	keep, before := m.History.limits()
+	return tx.PruneVersions(file.FilePath, keep, before)
+}
+
+// hasVersion reports whether the newest version of file in the history of m
+// has its indexed content, always true if m keeps no history. Files indexed
+// before history was enabled get their first version on the next scan.
+func (m *Monitor) hasVersion(tx IndexTx, file *IndexedFile) bool {
+	if m.History == nil {
+		return true
+	}
+	versions, err := tx.Versions(file.FilePath)
+	return err == nil && len(versions) > 0 && versions[0].Status == "ready" && versions[0].FileHash == file.FileHash
+}
+
+// pruneHistory drops the versions of all files that are past the retention
+// of m, even of files that haven't changed since.
+func (m *Monitor) pruneHistory() error {
+	if m.History == nil {
+		return nil
+	}
+	keep, before := m.History.limits()
+	return inTx(m.Store, func(tx IndexTx) error {
+		return tx.PruneVersions("", keep, before)
+	})
+}
@@ -1,14 +1,17 @@
 package index
 
 import (
-	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -21,6 +24,21 @@ type IndexedFile struct {
 	FileMode     os.FileMode
 	Status       string
 	LastIndexed  int64
+	ModifiedNs   int64
+	ChangedNs    int64
+	Inode        uint64
+	FileHash     string
+	// MovedFrom is set on the record of a path that was renamed from
+	// another one, MovedTo on the deleted record of the old path.
+	MovedFrom string
+	MovedTo   string
+	// Device and Links identify the hard links of a file, the records with
+	// its Device and Inode. Once all of its Links are indexed, every one of
+	// them but the first in path order is LinkedTo the first, so clients
+	// can link them as well.
+	Device   uint64
+	Links    uint64
+	LinkedTo string
 }
 
 type IndexedFilePart struct {
@@ -30,259 +48,635 @@ type IndexedFilePart struct {
 	Offset       int
 	Checksum     string
 	ChecksumType string
+	// StrongChecksum is the hex encoded sha256 of the part, clients use it
+	// to find identical blocks they already hold.
+	StrongChecksum string
 }
 
 const (
 	BLOCK_SIZE int64 = 1 << 20
 )
 
-func ProcessFileDelete(thePath string, monitored string) {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
-		}
-	}()
-	thePath = PathSafe(thePath)
-
-	db, _ := sql.Open("sqlite3", SlashSuffix(monitored)+".sync/index.db")
-	defer db.Close()
-
-	psDeleteFileParts, _ := db.Prepare("DELETE FROM FILE_PARTS WHERE FILE_PATH=?")
-	defer psDeleteFileParts.Close()
-
-	psDeleteFilePartsSub, _ := db.Prepare("DELETE FROM FILE_PARTS WHERE FILE_PATH LIKE ?")
-	defer psDeleteFilePartsSub.Close()
-
-	psUpdateFiles, _ := db.Prepare(`UPDATE FILES SET STATUS=?,LAST_INDEXED=? WHERE FILE_PATH=?`)
-	defer psUpdateFiles.Close()
-
-	psDeleteFilesSub, _ := db.Prepare(`DELETE FROM FILES WHERE FILE_PATH LIKE ? AND FILE_PATH!=?`)
-	defer psDeleteFilesSub.Close()
+// HOLE is the ChecksumType of a part that lies in a hole of a sparse file.
+// It reads as zeros, its Checksum is the CRC32 of the zeros and it has no
+// StrongChecksum, since no block is stored for it. Clients leave or punch a
+// hole there instead of downloading it.
+const HOLE = "HOLE"
+
+// zeroBlock is the content of a block in a hole.
+var zeroBlock = make([]byte, BLOCK_SIZE)
+
+// SCAN_BATCH_SIZE is the number of entries WatchRecursively checks and
+// writes per transaction while it walks a tree.
+const SCAN_BATCH_SIZE = 1000
+
+// Monitor is a monitored directory together with its index.
+type Monitor struct {
+	Monitored string
+	Store     IndexStore
+	// Blocks keeps the content of every indexed part by hash, it is nil
+	// unless the monitor has block_store enabled.
+	Blocks *BlockStore
+	// History is how long old versions are kept, nil if they aren't. It
+	// needs Blocks.
+	History *History
+	// A written file is indexed once it has had no writes for WriteQuiet,
+	// or WriteMaxWait after the first write at the latest. With WriteQuiet
+	// 0 files are indexed on every write.
+	WriteQuiet   time.Duration
+	WriteMaxWait time.Duration
+	// Clock drives the write debouncing, the real clock if nil.
+	Clock Clock
+	// PatrolInterval is how often the patrol walks the next PatrolBatch
+	// entries, 0 disables the patrol.
+	PatrolInterval time.Duration
+	PatrolBatch    int
+	// Workers is the number of files hashed at the same time, QueueSize
+	// how many changed files wait for them before changes are folded into
+	// directory rescans.
+	Workers   int
+	QueueSize int
+
+	mu    sync.Mutex // guards queue
+	queue *indexQueue
+}
 
-	psUpdateFileStatus, _ := db.Prepare(`UPDATE FILES
-	SET FILE_MODE=?,LAST_MODIFIED=?,LAST_INDEXED=? WHERE FILE_PATH=?`)
-	defer psUpdateFileStatus.Close()
+func ProcessFileDelete(m *Monitor, thePath string) {
+	err := inTx(m.Store, func(tx IndexTx) error {
+		return processFileDelete(tx, thePath, m)
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
 
-	psDeleteFileParts.Exec(thePath[len(monitored):])
-	psDeleteFilePartsSub.Exec(thePath[len(monitored):] + "/%")
+func processFileDelete(tx IndexTx, thePath string, m *Monitor) error {
+	thePath = PathSafe(thePath)
+	filePath := thePath[len(m.Monitored):]
+	pathDir := SlashSuffix(filePath)
 
-	psUpdateFiles.Exec("deleted", time.Now().Unix(), thePath[len(monitored):])
-	pathDir := SlashSuffix(thePath[len(monitored):])
-	psUpdateFiles.Exec("deleted", time.Now().Unix(), pathDir)
-	psDeleteFilesSub.Exec(pathDir+"%", pathDir)
+	if err := tx.DeleteFileParts(filePath); err != nil {
+		return err
+	}
+	deleted, err := tx.File(filePath)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{filePath, pathDir} {
+		file, err := tx.File(p)
+		if err != nil {
+			return err
+		}
+		if file == nil || file.Status == "deleted" {
+			continue
+		}
+		file.Status = "deleted"
+		file.LastIndexed = time.Now().Unix()
+		file.MovedFrom, file.MovedTo = "", ""
+		if err := tx.PutFile(*file); err != nil {
+			return err
+		}
+		if err := m.recordVersion(tx, *file, nil); err != nil {
+			return err
+		}
+	}
+	if m.History != nil {
+		files, err := tx.FilesUnder(pathDir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.Status != "ready" {
+				continue
+			}
+			file.Status = "deleted"
+			if err := m.recordVersion(tx, file, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.DeleteUnder(pathDir); err != nil {
+		return err
+	}
+	if deleted != nil && deleted.Links > 1 {
+		// one link less for the ones left
+		if err := relink(tx, m, deleted.Device, deleted.Inode); err != nil {
+			return err
+		}
+	}
+	return updateParentDir(tx, thePath, m.Monitored)
+}
 
-	parentDirInfo, _ := os.Lstat(filepath.Dir(thePath))
-	psUpdateFileStatus.Exec(parentDirInfo.Mode().Perm(), parentDirInfo.ModTime().Unix(), time.Now().Unix(), SlashSuffix(PathSafe(filepath.Dir(thePath))[len(monitored):]))
+// updateParentDir refreshes the mode and mtime of the directory holding thePath.
+func updateParentDir(tx IndexTx, thePath string, monitored string) error {
+	parentDirInfo, err := os.Lstat(filepath.Dir(thePath))
+	if err != nil {
+		// the parent is gone as well, its own event will be processed
+		return nil
+	}
+	dir, err := tx.File(SlashSuffix(PathSafe(filepath.Dir(thePath))[len(monitored):]))
+	if err != nil || dir == nil {
+		return err
+	}
+	dir.FileMode = parentDirInfo.Mode().Perm()
+	dir.Status = "ready"
+	dir.LastModified = parentDirInfo.ModTime().Unix()
+	dir.ModifiedNs = parentDirInfo.ModTime().UnixNano()
+	dir.LastIndexed = time.Now().Unix()
+	return tx.PutFile(*dir)
 }
 
-func ProcessDirChange(thePath string, info os.FileInfo, monitored string) {
+func ProcessDirChange(m *Monitor, thePath string, info os.FileInfo) {
 	if info == nil {
 		fmt.Println("Dir no longer exists: " + thePath)
 		return
 	}
 	thePath = PathSafe(thePath)
 
-	db, _ := sql.Open("sqlite3", SlashSuffix(monitored)+".sync/index.db")
-	defer db.Close()
-
-	psUpdateFileStatus, _ := db.Prepare(`UPDATE FILES
-	SET LAST_MODIFIED=?,FILE_MODE=?,LAST_INDEXED=? WHERE FILE_PATH=?`)
-	defer psUpdateFileStatus.Close()
-
-	psUpdateFileStatus.Exec(info.ModTime().Unix(), info.Mode().Perm(), time.Now().Unix(), SlashSuffix(thePath[len(monitored):]))
+	err := inTx(m.Store, func(tx IndexTx) error {
+		dir, err := tx.File(SlashSuffix(thePath[len(m.Monitored):]))
+		if err != nil || dir == nil {
+			return err
+		}
+		dir.LastModified = info.ModTime().Unix()
+		dir.ModifiedNs = info.ModTime().UnixNano()
+		dir.FileMode = info.Mode().Perm()
+		dir.LastIndexed = time.Now().Unix()
+		return tx.PutFile(*dir)
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
-func ProcessFileChange(thePath string, info os.FileInfo, monitored string) {
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
-		}
-	}()
+// ProcessFileChange reindexes a single file. The file is read outside of
+// any transaction, so other changes aren't held up while a large file is
+// hashed, then its record and all of its parts are updated together. A file
+// that changed while it was read is left to the event of that change.
+func ProcessFileChange(m *Monitor, thePath string, info os.FileInfo) {
 	if info == nil {
 		fmt.Println("File no longer exists: " + thePath)
 		return
 	}
-	thePath = PathSafe(thePath)
-
-	db, _ := sql.Open("sqlite3", monitored+"/.sync/index.db")
-	defer db.Close()
-
-	psSelectFile, _ := db.Prepare("SELECT * FROM FILES WHERE FILE_PATH=?")
-	defer psSelectFile.Close()
-
-	psSelectFileParts, _ := db.Prepare("SELECT * FROM FILE_PARTS WHERE FILE_PATH=? ORDER BY SEQ")
-	defer psSelectFileParts.Close()
-
-	psInsertFiles, _ := db.Prepare(`INSERT INTO FILES
-	(FILE_PATH,LAST_MODIFIED,FILE_SIZE,FILE_MODE,STATUS,LAST_INDEXED)
-	VALUES(?,?,?,?,?,?)`)
-	defer psInsertFiles.Close()
-
-	psUpdateFiles, _ := db.Prepare(`UPDATE FILES
-	SET LAST_MODIFIED=?,FILE_SIZE=?,FILE_MODE=?,STATUS=?,LAST_INDEXED=?
-	WHERE FILE_PATH=?`)
-	defer psUpdateFiles.Close()
-
-	psUpdateFileStatus, _ := db.Prepare(`UPDATE FILES
-	SET FILE_MODE=?,STATUS=?,LAST_MODIFIED=?,LAST_INDEXED=? WHERE FILE_PATH=?`)
-	defer psUpdateFileStatus.Close()
-
-	psInsertFileParts, _ := db.Prepare(`INSERT INTO FILE_PARTS
-	(FILE_PATH,SEQ,START_INDEX,OFFSET,CHECKSUM,CHECKSUM_TYPE)
-	VALUES(?,?,?,?,?,?)`)
-	defer psInsertFileParts.Close()
-
-	psUpdateFileParts, _ := db.Prepare(`UPDATE FILE_PARTS
-	SET START_INDEX=?,OFFSET=?,CHECKSUM=?,CHECKSUM_TYPE=?
-	WHERE FILE_PATH=? AND SEQ=?`)
-	defer psUpdateFileParts.Close()
+	if err := m.indexFile(PathSafe(thePath), info); err != nil {
+		fmt.Println(err)
+	}
+}
 
-	psDeleteFileParts, _ := db.Prepare(`DELETE FROM FILE_PARTS WHERE FILE_PATH=? AND SEQ=?`)
-	defer psDeleteFileParts.Close()
+// The states indexFile takes a file through.
+const (
+	INDEX_CHECK = iota // compare the record with the stat of the file
+	INDEX_READ         // hash the file block by block
+	INDEX_PUT          // write the record and the parts that changed
+	INDEX_DONE
+)
 
-	insert := false
-	file := new(IndexedFile)
-	err := psSelectFile.QueryRow(thePath[len(monitored):]).Scan(&file.FilePath, &file.LastModified,
-		&file.FileSize, &file.FileMode, &file.Status, &file.LastIndexed)
-	if err == sql.ErrNoRows {
-		insert = true
-	}
-	if !insert && info.ModTime().Unix() == file.LastModified && info.Size() == file.FileSize && info.Mode().Perm() == file.FileMode && file.Status != "deleted" {
-		// file unchanged
-		//fmt.Println(file.FilePath + " unchanged.")
-		return
+// indexFile brings the record of thePath in line with the file, each step
+// that touches the index in a transaction of its own. The file is left alone
+// if its stat changed while it was read.
+func (m *Monitor) indexFile(thePath string, info os.FileInfo) error {
+	var indexed IndexedFile
+	var parts []IndexedFilePart
+	state := INDEX_CHECK
+	for state != INDEX_DONE {
+		switch state {
+		case INDEX_CHECK:
+			state = INDEX_READ
+			err := inTx(m.Store, func(tx IndexTx) error {
+				current, err := m.upToDate(tx, thePath, info)
+				if current {
+					state = INDEX_DONE
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		case INDEX_READ:
+			var err error
+			if indexed, parts, err = m.readFile(thePath, info); err != nil {
+				return err
+			}
+			state = INDEX_PUT
+		case INDEX_PUT:
+			state = INDEX_DONE
+			err := inTx(m.Store, func(tx IndexTx) error {
+				if now, err := os.Lstat(thePath); err != nil || !sameStat(now, info) {
+					// changed or gone while it was read
+					return nil
+				}
+				return putFile(tx, thePath, indexed, parts, m)
+			})
+			if err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	// now we think file has been changed
-	if insert {
-		psInsertFiles.Exec(thePath[len(monitored):], info.ModTime().Unix(), info.Size(), info.Mode().Perm(), "updating", time.Now().Unix())
-	} else {
-		psUpdateFiles.Exec(info.ModTime().Unix(), info.Size(), info.Mode().Perm(), "updating", time.Now().Unix(), thePath[len(monitored):])
+// upToDate reports whether the index of m has thePath as it is on disk.
+func (m *Monitor) upToDate(tx IndexTx, thePath string, info os.FileInfo) (bool, error) {
+	filePath := thePath[len(m.Monitored):]
+	file, err := tx.File(filePath)
+	if err != nil {
+		return false, err
 	}
+	return file != nil && unchanged(file, thePath, info) && m.hasBlocks(tx, filePath) && m.hasVersion(tx, file), nil
+}
 
-	blocks := int(math.Ceil(float64(info.Size()) / float64(BLOCK_SIZE)))
-	if blocks == 0 {
-		blocks = 1
+// readFile hashes thePath block by block and returns its record and parts,
+// the blocks go to the block store of m if it keeps one.
+func (m *Monitor) readFile(thePath string, info os.FileInfo) (IndexedFile, []IndexedFilePart, error) {
+	filePath := thePath[len(m.Monitored):]
+	f, err := os.Open(thePath)
+	if err != nil {
+		return IndexedFile{}, nil, err
 	}
+	defer f.Close()
 
-	sliceFileParts := make([]IndexedFilePart, 0, 10)
-	rows, _ := psSelectFileParts.Query(thePath[len(monitored):])
-	defer rows.Close()
-	for rows.Next() {
-		filePart := new(IndexedFilePart)
-		rows.Scan(&filePart.FilePath, &filePart.Seq, &filePart.StartIndex, &filePart.Offset, &filePart.Checksum, &filePart.ChecksumType)
-		sliceFileParts = append(sliceFileParts, *filePart)
-	}
+	// an empty file has no parts
+	blocks := int(math.Ceil(float64(info.Size()) / float64(BLOCK_SIZE)))
 
 	h := crc32.NewIEEE()
-	f, _ := os.Open(thePath)
-	defer f.Close()
+	fileHash := sha256.New()
+	bufSize := BLOCK_SIZE
+	if info.Size() < bufSize {
+		bufSize = info.Size()
+	}
+	buf := make([]byte, bufSize)
+	parts := make([]IndexedFilePart, 0, blocks)
+	fileHoles := holes(f, info.Size())
 	for i := 0; i < blocks; i++ {
-		var fp IndexedFilePart
-		insertFP := false
-		if i < len(sliceFileParts) {
-			fp = sliceFileParts[i]
-		} else {
-			//fp = *new(IndexedFilePart)
-			insertFP = true
+		start := int64(i) * BLOCK_SIZE
+		end := start + BLOCK_SIZE
+		if end > info.Size() {
+			end = info.Size()
+		}
+		for len(fileHoles) > 0 && fileHoles[0][1] <= start {
+			fileHoles = fileHoles[1:]
+		}
+		if start < end && len(fileHoles) > 0 && fileHoles[0][0] <= start && end <= fileHoles[0][1] {
+			// the block is all hole, it reads as zeros and isn't stored
+			zeros := zeroBlock[:end-start]
+			h.Reset()
+			h.Write(zeros)
+			fileHash.Write(zeros)
+			parts = append(parts, IndexedFilePart{
+				FilePath:     filePath,
+				Seq:          i,
+				StartIndex:   start,
+				Offset:       len(zeros),
+				Checksum:     fmt.Sprint(h.Sum32()),
+				ChecksumType: HOLE,
+			})
+			continue
 		}
 
-		buf := make([]byte, BLOCK_SIZE)
-		n, _ := f.ReadAt(buf, int64(i)*BLOCK_SIZE)
+		n, err := f.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return IndexedFile{}, nil, err
+		}
 
 		h.Reset()
 		h.Write(buf[:n])
-		v := fmt.Sprint(h.Sum32())
-
-		if v != fp.Checksum {
-			// part changed
-			fp.Checksum = v
-			fp.ChecksumType = "CRC32"
-			fp.StartIndex = int64(i) * BLOCK_SIZE
-			fp.Offset = n
-			fp.FilePath = thePath[len(monitored):]
-			fp.Seq = i
-
-			if insertFP {
-				psInsertFileParts.Exec(fp.FilePath, fp.Seq, fp.StartIndex, fp.Offset, fp.Checksum, fp.ChecksumType)
-			} else {
-				psUpdateFileParts.Exec(fp.StartIndex, fp.Offset, fp.Checksum, fp.ChecksumType, fp.FilePath, fp.Seq)
+		fileHash.Write(buf[:n])
+		strong := sha256.Sum256(buf[:n])
+		strongChecksum := hex.EncodeToString(strong[:])
+		if m.Blocks != nil {
+			if err := m.Blocks.Put(strongChecksum, buf[:n]); err != nil {
+				return IndexedFile{}, nil, err
 			}
 		}
-		fp.Checksum = v
+		parts = append(parts, IndexedFilePart{
+			FilePath:       filePath,
+			Seq:            i,
+			StartIndex:     start,
+			Offset:         n,
+			Checksum:       fmt.Sprint(h.Sum32()),
+			ChecksumType:   "CRC32",
+			StrongChecksum: strongChecksum,
+		})
+	}
+
+	changedNs, inode := fileStat(info)
+	device, links := fileLinks(info)
+	return IndexedFile{
+		FilePath:     filePath,
+		LastModified: info.ModTime().Unix(),
+		FileSize:     info.Size(),
+		FileMode:     info.Mode().Perm(),
+		Status:       "ready",
+		ModifiedNs:   info.ModTime().UnixNano(),
+		ChangedNs:    changedNs,
+		Inode:        inode,
+		FileHash:     hex.EncodeToString(fileHash.Sum(nil)),
+		Device:       device,
+		Links:        links,
+	}, parts, nil
+}
+
+// putFile writes the record and parts of a file read by readFile, only the
+// parts that changed are written.
+func putFile(tx IndexTx, thePath string, indexed IndexedFile, parts []IndexedFilePart, m *Monitor) error {
+	if err := putParts(tx, indexed.FilePath, parts); err != nil {
+		return err
+	}
+
+	// stamped at commit, so clients polling since an earlier time get it
+	indexed.LastIndexed = time.Now().Unix()
+	if err := tx.PutFile(indexed); err != nil {
+		return err
 	}
-	if len(sliceFileParts) > blocks {
-		for i := blocks; i < len(sliceFileParts); i-- {
-			psDeleteFileParts.Exec(thePath[len(monitored):], i)
+	if err := m.recordVersion(tx, indexed, parts); err != nil {
+		return err
+	}
+	if indexed.Links > 1 {
+		if err := putLinks(tx, thePath, indexed, parts, m); err != nil {
+			return err
 		}
 	}
-	psUpdateFileStatus.Exec(info.Mode().Perm(), "ready", info.ModTime().Unix(), time.Now().Unix(), thePath[len(monitored):])
-	parentDirInfo, _ := os.Lstat(filepath.Dir(thePath))
-	psUpdateFileStatus.Exec(parentDirInfo.Mode().Perm(), "ready", parentDirInfo.ModTime().Unix(), time.Now().Unix(), SlashSuffix(PathSafe(filepath.Dir(thePath))[len(monitored):]))
+	return updateParentDir(tx, thePath, m.Monitored)
 }
 
-func WatchRecursively(watcher *fsnotify.Watcher, root string, monitored string) error {
-	safeRoot := PathSafe(root)
+// putParts writes the parts of filePath that changed and drops the ones
+// past the end.
+func putParts(tx IndexTx, filePath string, parts []IndexedFilePart) error {
+	sliceFileParts, err := tx.FileParts(filePath)
+	if err != nil {
+		return err
+	}
+	for i, fp := range parts {
+		if i < len(sliceFileParts) && sliceFileParts[i] == fp {
+			// part unchanged
+			continue
+		}
+		if err := tx.PutFilePart(fp); err != nil {
+			return err
+		}
+	}
+	if len(sliceFileParts) > len(parts) {
+		if err := tx.TruncateFileParts(filePath, len(parts)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	db, _ := sql.Open("sqlite3", SlashSuffix(monitored)+".sync/index.db")
-	defer db.Close()
+// sameStat reports whether two stats of a file show no change in between.
+func sameStat(a os.FileInfo, b os.FileInfo) bool {
+	aChangedNs, aInode := fileStat(a)
+	bChangedNs, bInode := fileStat(b)
+	return a.Size() == b.Size() && a.Mode() == b.Mode() && a.ModTime().Equal(b.ModTime()) &&
+		aChangedNs == bChangedNs && aInode == bInode
+}
+
+// unchanged reports whether the indexed record still matches the file on disk.
+// The nanosecond mtime is compared, plus ctime and inode where the platform
+// provides them. On filesystems with whole-second timestamps, a file modified
+// in the same second it was last indexed could have been rewritten without
+// any visible change, so its content hash is checked as well.
+func unchanged(file *IndexedFile, thePath string, info os.FileInfo) bool {
+	if !sameMetadata(file, info) {
+		return false
+	}
+	if info.ModTime().Nanosecond() == 0 && info.ModTime().Unix() >= file.LastIndexed {
+		return file.FileHash != "" && file.FileHash == HashFile(thePath)
+	}
+	return true
+}
+
+// sameMetadata reports whether the stat of a file matches its record.
+func sameMetadata(file *IndexedFile, info os.FileInfo) bool {
+	if file.Status != "ready" || info.Size() != file.FileSize || info.Mode().Perm() != file.FileMode {
+		return false
+	}
+	if info.ModTime().UnixNano() != file.ModifiedNs {
+		return false
+	}
+	changedNs, inode := fileStat(info)
+	return changedNs == file.ChangedNs && inode == file.Inode
+}
+
+// HashFile returns the hex encoded sha256 of the file content.
+func HashFile(thePath string) string {
+	f, err := os.Open(thePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// WatchRecursively adds watches for every directory under root and brings
+// the index in line with the tree, SCAN_BATCH_SIZE entries at a time. It
+// returns the number of entries walked.
+func WatchRecursively(watcher Watcher, root string, m *Monitor) (int, error) {
+	monitored, store := m.Monitored, m.Store
+	safeRoot := PathSafe(root)
 
 	mapFiles := make(map[string]IndexedFile)
-	psSelectFilesLike, _ := db.Prepare("SELECT * FROM FILES WHERE FILE_PATH LIKE ?")
-	defer psSelectFilesLike.Close()
-	rows, _ := psSelectFilesLike.Query(SlashSuffix(LikeSafe(safeRoot)[len(monitored):]) + "%")
-	defer rows.Close()
-	for rows.Next() {
-		file := new(IndexedFile)
-		rows.Scan(&file.FilePath, &file.LastModified, &file.FileSize, &file.FileMode, &file.Status, &file.LastIndexed)
-		mapFiles[file.FilePath] = *file
-	}
-	psInsertFiles, _ := db.Prepare(`INSERT INTO FILES
-	(FILE_PATH,LAST_MODIFIED,FILE_SIZE,FILE_MODE,STATUS,LAST_INDEXED)
-	VALUES(?,?,?,?,?,?)`)
-	defer psInsertFiles.Close()
-
-	psUpdateFiles, _ := db.Prepare(`UPDATE FILES
-	SET FILE_MODE=?,STATUS='ready',LAST_MODIFIED=?,LAST_INDEXED=? WHERE FILE_PATH=?`)
-	defer psUpdateFiles.Close()
+	files, err := store.FilesUnder(SlashSuffix(safeRoot)[len(monitored):])
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		mapFiles[file.FilePath] = file
+	}
 
+	walked, unwatched := 0, 0
+	batch := make([]scanEntry, 0, SCAN_BATCH_SIZE)
+	var batchErr error
 	filepath.Walk(safeRoot,
 		func(path string, info os.FileInfo, err error) error {
-			var thePath string
-			if info.IsDir() {
-				thePath = SlashSuffix(PathSafe(path))
-				if strings.HasPrefix(thePath, SlashSuffix(safeRoot)+".sync/") {
-					return nil
+			if err != nil {
+				return nil
+			}
+			if isIndexPath(m, path) {
+				if info.IsDir() {
+					return filepath.SkipDir
 				}
-
-				watcher.Add(thePath[0 : len(thePath)-1])
-				// update index
-				if v, ok := mapFiles[thePath[len(monitored):]]; !ok {
-					psInsertFiles.Exec(thePath[len(monitored):], info.ModTime().Unix(), -1, uint32(info.Mode().Perm()), "ready", time.Now().Unix())
-				} else {
-					if v.Status != "ready" {
-						psUpdateFiles.Exec(info.Mode().Perm(), info.ModTime().Unix(), time.Now().Unix(), v.FilePath)
+				return nil
+			}
+			thePath := PathSafe(path)
+			if info.IsDir() {
+				thePath = SlashSuffix(thePath)
+				if err := watcher.Add(thePath[0 : len(thePath)-1]); err != nil {
+					if unwatched == 0 {
+						fmt.Println("Failed to watch", thePath, err)
 					}
+					unwatched++
 				}
-			} else {
-				thePath = PathSafe(path)
-				if strings.HasPrefix(PathSafe(filepath.Dir(thePath)), SlashSuffix(safeRoot)+".sync") {
-					return nil
+			}
+			filePath := thePath[len(monitored):]
+			known, ok := mapFiles[filePath]
+			delete(mapFiles, filePath)
+			batch = append(batch, scanEntry{thePath, info, known, ok})
+			walked++
+			if len(batch) >= SCAN_BATCH_SIZE {
+				if batchErr = m.indexBatch(batch); batchErr != nil {
+					return batchErr
 				}
-				ProcessFileChange(thePath, info, monitored)
+				batch = batch[:0]
 			}
-			delete(mapFiles, thePath[len(monitored):])
 			return nil
 		})
+	if batchErr == nil {
+		batchErr = m.indexBatch(batch)
+	}
+	if batchErr != nil {
+		return walked, batchErr
+	}
+	if unwatched > 1 {
+		fmt.Println("Failed to watch", unwatched, "directories in", safeRoot)
+	}
 	// remove zombies
-	for k, v := range mapFiles {
-		if k != "/" && v.Status == "ready" {
-			fmt.Println("Zombie removed: ", v.FilePath)
-			ProcessFileDelete(monitored+k, monitored)
+	err = inTx(store, func(tx IndexTx) error {
+		for k, v := range mapFiles {
+			if k != "/" && v.Status == "ready" {
+				fmt.Println("Zombie removed: ", v.FilePath)
+				if err := processFileDelete(tx, monitored+k, m); err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+		return nil
+	})
+	return walked, err
+}
+
+// scanEntry is an entry walked by WatchRecursively, with its record if it
+// had one.
+type scanEntry struct {
+	thePath string
+	info    os.FileInfo
+	known   IndexedFile
+	ok      bool
+}
+
+// scannedFile is a file of a batch that has been read.
+type scannedFile struct {
+	thePath string
+	info    os.FileInfo
+	indexed IndexedFile
+	parts   []IndexedFilePart
+}
+
+// indexBatch brings the records of a batch of entries in line with them.
+// The directories are written and the files checked in one transaction,
+// the files that changed are then read outside of any, so the workers and
+// the events aren't held up while they are hashed, and written together in
+// a second one. As in ProcessFileChange, a file that changed while it was
+// read is left to the event of that change.
+func (m *Monitor) indexBatch(entries []scanEntry) error {
+	changed := make([]scanEntry, 0)
+	err := inTx(m.Store, func(tx IndexTx) error {
+		for _, e := range entries {
+			var err error
+			if e.info.IsDir() {
+				err = putDir(tx, e, m)
+			} else if current, checkErr := m.upToDate(tx, e.thePath, e.info); checkErr != nil {
+				err = checkErr
+			} else if !current {
+				changed = append(changed, e)
+			}
+			if err != nil {
+				fmt.Println(e.thePath, err)
+			}
 		}
+		return nil
+	})
+	if err != nil || len(changed) == 0 {
+		return err
 	}
 
-	return nil
+	read := make([]scannedFile, 0, len(changed))
+	for _, e := range changed {
+		indexed, parts, err := m.readFile(e.thePath, e.info)
+		if err != nil {
+			fmt.Println(e.thePath, err)
+			continue
+		}
+		read = append(read, scannedFile{e.thePath, e.info, indexed, parts})
+	}
+	return inTx(m.Store, func(tx IndexTx) error {
+		for _, f := range read {
+			if now, err := os.Lstat(f.thePath); err != nil || !sameStat(now, f.info) {
+				continue
+			}
+			err := tx.Savepoint(func() error {
+				return putFile(tx, f.thePath, f.indexed, f.parts, m)
+			})
+			if err != nil {
+				fmt.Println(f.thePath, err)
+			}
+		}
+		return nil
+	})
+}
+
+// putDir writes the record of a directory walked by WatchRecursively if it
+// has none or it doesn't match.
+func putDir(tx IndexTx, e scanEntry, m *Monitor) error {
+	info, v := e.info, e.known
+	changedNs, inode := fileStat(info)
+	if !e.ok {
+		return tx.PutFile(IndexedFile{
+			FilePath:     e.thePath[len(m.Monitored):],
+			LastModified: info.ModTime().Unix(),
+			ModifiedNs:   info.ModTime().UnixNano(),
+			FileSize:     -1,
+			FileMode:     info.Mode().Perm(),
+			Status:       "ready",
+			LastIndexed:  time.Now().Unix(),
+			ChangedNs:    changedNs,
+			Inode:        inode,
+		})
+	}
+	if v.Status == "ready" && v.Inode == inode && v.FileMode == info.Mode().Perm() &&
+		v.ModifiedNs == info.ModTime().UnixNano() {
+		return nil
+	}
+	// directories indexed before inodes were recorded get theirs too, moves
+	// are recognized by them, and a mode changed while nothing watched is
+	// picked up
+	v.FileMode = info.Mode().Perm()
+	v.Status = "ready"
+	v.LastModified = info.ModTime().Unix()
+	v.ModifiedNs = info.ModTime().UnixNano()
+	v.LastIndexed = time.Now().Unix()
+	v.ChangedNs = changedNs
+	v.Inode = inode
+	v.MovedTo = ""
+	return tx.PutFile(v)
+}
+
+// watchDirs adds watches for every directory under root, without indexing
+// anything.
+func watchDirs(watcher Watcher, root string, m *Monitor) {
+	unwatched := 0
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if isIndexPath(m, path) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			if unwatched == 0 {
+				fmt.Println("Failed to watch", path, err)
+			}
+			unwatched++
+		}
+		return nil
+	})
+	if unwatched > 1 {
+		fmt.Println("Failed to watch", unwatched, "directories in", root)
+	}
 }
 
 func SlashSuffix(path string) string {
@@ -297,43 +691,6 @@ func PathSafe(path string) string {
 	//path, _ = filepath.Abs(path)
 	return path
 }
-func LikeSafe(path string) string {
-	path = strings.Replace(path, "_", "\\_", -1)
-	return path
-}
-
-func InitIndex(monitored string, db *sql.DB) error {
-	var ret error = nil
-	exists := exists(SlashSuffix(monitored) + ".sync/index.db")
-	if !exists {
-		os.MkdirAll(SlashSuffix(monitored)+".sync/", (os.FileMode)(0755))
-		db.Exec(`
-			CREATE TABLE FILE_PARTS(
-				FILE_PATH TEXT NOT NULL,
-				SEQ INTEGER NOT NULL,
-				START_INDEX INTEGER NOT NULL,
-				OFFSET INTEGER NOT NULL,
-				CHECKSUM TEXT NOT NULL,
-				CHECKSUM_TYPE TEXT NOT NULL,
-				PRIMARY KEY(FILE_PATH, SEQ)
-			);
-		`)
-		db.Exec(`
-			CREATE TABLE FILES(
-				FILE_PATH TEXT PRIMARY KEY,
-				LAST_MODIFIED INTEGER NOT NULL,
-				FILE_SIZE INTEGER NOT NULL,
-				FILE_MODE INTEGER NOT NULL,
-				STATUS TEXT NOT NULL,
-				LAST_INDEXED INTEGER NOT NULL
-			);
-		`)
-		db.Exec("CREATE INDEX IDX_FILES_FILESIZE ON FILES(FILE_SIZE);")
-		db.Exec("CREATE INDEX IDX_FILES_STATUS ON FILES(STATUS);")
-		db.Exec("CREATE INDEX IDX_FILES_LASTINDEXED ON FILES(LAST_INDEXED);")
-	}
-	return ret
-}
 
 // exists returns whether the given file or directory exists or not
 func exists(path string) bool {
@@ -347,51 +704,123 @@ func exists(path string) bool {
 	return false
 }
 
-func ProcessEvent(watcher *fsnotify.Watcher, monitored string) {
+// ProcessEvent brings the index of m in line with the events of watcher
+// until it is closed. Deletes, moves and directories are indexed right away,
+// changed files are left to the workers of an indexQueue.
+func ProcessEvent(watcher Watcher, m *Monitor) {
+	queue := newIndexQueue(m, watcher)
+	defer queue.close()
+	m.mu.Lock()
+	m.queue = queue
+	m.mu.Unlock()
+	moves := make(pendingMoves)
+	writes := newDebouncer(m.WriteQuiet, m.WriteMaxWait, m.Clock)
+	patroller := &patrol{m: m, watcher: watcher, queue: queue}
+	collect := time.NewTicker(BLOCK_GRACE)
+	defer collect.Stop()
+	patrolTicks, stopPatrol := m.patrolTicker()
+	defer stopPatrol()
+	// fires once m has been quiet long enough for a new generation
+	quiet := m.quietTimer()
 	for {
 		select {
-		case ev := <-watcher.Events:
-			//fmt.Println("event:", ev, ":", monitored)
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				// the watcher has been closed
+				return
+			}
+			quiet = m.quietTimer()
+			//fmt.Println("event:", ev, ":", m.Monitored)
 			info, _ := os.Lstat(ev.Name)
 			if info == nil {
-				ProcessFileDelete(ev.Name, monitored)
-			} else if ev.Op&fsnotify.Create == fsnotify.Create {
-				if info.IsDir() {
-					WatchRecursively(watcher, ev.Name, monitored)
-					//fmt.Println("Created dir: " + ev.Name)
-				} else {
-					ProcessFileChange(ev.Name, info, monitored)
-					//fmt.Println("Created file: " + ev.Name)
+				if ev.Op&fsnotify.Rename == fsnotify.Rename && moves.add(m.Store, ev.Name, m.Monitored) {
+					// wait for the new name to show up
+					continue
 				}
+				writes.remove(ev.Name)
+				ProcessFileDelete(m, ev.Name)
+			} else if ev.Op&fsnotify.Create == fsnotify.Create {
+				processCreate(watcher, ev.Name, info, m, moves, writes, queue)
 			} else if ev.Op&fsnotify.Write == fsnotify.Write {
 				if info.IsDir() {
-					ProcessDirChange(ev.Name, info, monitored)
+					ProcessDirChange(m, ev.Name, info)
 					//fmt.Println("Modified dir: " + ev.Name)
-				} else {
-					ProcessFileChange(ev.Name, info, monitored)
+				} else if !writes.add(ev.Name) {
+					queue.push(ev.Name)
 					//fmt.Println("Modified file: " + ev.Name)
 				}
 			} else if ev.Op&fsnotify.Remove == fsnotify.Remove {
-				ProcessFileDelete(ev.Name, monitored)
+				writes.remove(ev.Name)
+				ProcessFileDelete(m, ev.Name)
 				//fmt.Println("Deleted: " + ev.Name)
 			} else if ev.Op&fsnotify.Rename == fsnotify.Rename {
-				if exists(ev.Name) {
-					if info.IsDir() {
-						WatchRecursively(watcher, ev.Name, monitored)
-						//fmt.Println("Created dir: " + ev.Name)
-					} else {
-						ProcessFileChange(ev.Name, info, monitored)
-						//fmt.Println("Created file: " + ev.Name)
-					}
+				processCreate(watcher, ev.Name, info, m, moves, writes, queue)
+			} else if ev.Op&fsnotify.Chmod == fsnotify.Chmod {
+				// the mode is part of the record, and files are left to
+				// upToDate as attributes change for other reasons too
+				if info.IsDir() {
+					ProcessDirChange(m, ev.Name, info)
 				} else {
-					ProcessFileDelete(ev.Name, monitored)
+					queue.push(ev.Name)
 				}
 			}
-		case err := <-watcher.Errors:
-			fmt.Println("error:", err)
-		case <-time.After(time.Minute):
+		case <-writes.timer():
+			for _, thePath := range writes.due(writes.clock.Now()) {
+				queue.push(thePath)
+			}
+			quiet = m.quietTimer()
+		case <-queue.done:
+			quiet = m.quietTimer()
+		case <-moves.timer():
+			for _, from := range moves.expired(time.Now()) {
+				ProcessFileDelete(m, from)
+			}
+			quiet = m.quietTimer()
+		case <-quiet:
+			if len(moves) > 0 || len(writes.pending) > 0 || queue.busy() {
+				// a move is only half done, or a file still being written
+				// or indexed
+				quiet = m.quietTimer()
+				continue
+			}
+			quiet = nil
+			if err := m.newGeneration(); err != nil {
+				fmt.Println(err)
+			}
+		case err, ok := <-watcher.Errors():
+			if !ok {
+				return
+			}
+			// events may have been dropped, only a rescan tells what changed
+			queue.lost(err)
+		case <-patrolTicks:
 			//fmt.Println("I'm idle, so I decided to do a patrol")
-			WatchRecursively(watcher, monitored, monitored)
+			if patroller.tick() {
+				quiet = m.quietTimer()
+			}
+		case <-collect.C:
+			m.collect()
 		}
 	}
 }
+
+// processCreate indexes a path that appeared, as the new name of a pending
+// move if one matches. A new file is queued once writes to it have settled.
+func processCreate(watcher Watcher, thePath string, info os.FileInfo, m *Monitor, moves pendingMoves,
+	writes *debouncer, queue *indexQueue) {
+	if from := moves.match(thePath, info); from != "" {
+		delete(moves, from)
+		ProcessMove(m, from, thePath, info)
+		//fmt.Println("Moved: " + from + " to " + thePath)
+	}
+	if info.IsDir() {
+		// watched right away so nothing created in it is missed, the
+		// workers index what it holds
+		watchDirs(watcher, thePath, m)
+		queue.rescan(thePath)
+		//fmt.Println("Created dir: " + thePath)
+	} else if !writes.add(thePath) {
+		queue.push(thePath)
+		//fmt.Println("Created file: " + thePath)
+	}
+}
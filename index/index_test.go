@@ -0,0 +1,306 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// scanFiles is the size of the tree BenchmarkWatchRecursively scans, run it
+// with -scan.files=1000000 to measure a large share.
+var scanFiles = flag.Int("scan.files", 10000, "files in the tree scanned by BenchmarkWatchRecursively")
+
+// scanFixture writes files small files into root, 1000 to a directory.
+func scanFixture(b *testing.B, root string, files int) {
+	content := []byte("filesync")
+	for i := 0; i < files; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("d%04d", i/1000))
+		if i%1000 == 0 {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%04d", i%1000)), content, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWatchRecursively measures the first scan of a share into an
+// empty index, and the rescan of the unchanged share at startup.
+func BenchmarkWatchRecursively(b *testing.B) {
+	root := b.TempDir()
+	scanFixture(b, root, *scanFiles)
+
+	for _, kind := range []string{"memory", "sqlite"} {
+		for _, rescan := range []bool{false, true} {
+			name := kind + "/scan"
+			if rescan {
+				name = kind + "/rescan"
+			}
+			b.Run(name, func(b *testing.B) {
+				walked := 0
+				var elapsed time.Duration
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					store, err := OpenStore(kind, b.TempDir())
+					if err != nil {
+						b.Skip(err)
+					}
+					m := &Monitor{Monitored: root, Store: store}
+					watcher := newPollWatcher(time.Hour)
+					if rescan {
+						if _, err := WatchRecursively(watcher, root, m); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.StartTimer()
+					started := time.Now()
+					n, err := WatchRecursively(watcher, root, m)
+					elapsed += time.Since(started)
+					b.StopTimer()
+					if err != nil {
+						b.Fatal(err)
+					}
+					walked += n
+					watcher.Close()
+					store.Close()
+					b.StartTimer()
+				}
+				b.ReportMetric(float64(walked)/elapsed.Seconds(), "entries/s")
+			})
+		}
+	}
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		thePath := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(thePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(thePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIndexStat(t *testing.T) {
+	dir := t.TempDir()
+	m := &Monitor{Monitored: dir, Store: NewMemoryStore()}
+	defer m.Store.Close()
+	thePath := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(thePath, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Unix(1000000000, 123456789)
+	if err := os.Chtimes(thePath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Lstat(thePath)
+	ProcessFileChange(m, thePath, info)
+	file, _ := m.Store.File("/a.txt")
+	changedNs, inode := fileStat(info)
+	if file == nil || file.LastModified != modified.Unix() || file.ModifiedNs != modified.UnixNano() ||
+		file.ChangedNs != changedNs || file.Inode != inode || file.FileHash != HashFile(thePath) {
+		t.Fatalf("the stat of the file is indexed as %+v", file)
+	}
+	if !unchanged(file, thePath, info) {
+		t.Error("the file changed since it was indexed")
+	}
+
+	for name, change := range map[string]func(file *IndexedFile){
+		"size":        func(file *IndexedFile) { file.FileSize++ },
+		"mode":        func(file *IndexedFile) { file.FileMode = 0600 },
+		"nanoseconds": func(file *IndexedFile) { file.ModifiedNs++ },
+		"ctime":       func(file *IndexedFile) { file.ChangedNs++ },
+		"inode":       func(file *IndexedFile) { file.Inode++ },
+		"deleted":     func(file *IndexedFile) { file.Status = "deleted" },
+	} {
+		changed := *file
+		change(&changed)
+		if unchanged(&changed, thePath, info) {
+			t.Errorf("a file whose %s changed is unchanged", name)
+		}
+	}
+
+	// whole seconds can't tell a rewrite in the second it was indexed
+	modified = time.Unix(time.Now().Unix(), 0)
+	if err := os.Chtimes(thePath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Lstat(thePath)
+	ProcessFileChange(m, thePath, info)
+	file, _ = m.Store.File("/a.txt")
+	if !unchanged(file, thePath, info) {
+		t.Error("the file changed since it was indexed")
+	}
+	rewritten := *file
+	rewritten.FileHash = HashFile(thePath) + "0"
+	if unchanged(&rewritten, thePath, info) {
+		t.Error("a file rewritten in the second it was indexed is unchanged")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	m := &Monitor{Monitored: dir}
+	for _, c := range []struct {
+		name string
+		size int64
+	}{
+		{"empty", 0},
+		{"one block", 100},
+		{"full block", BLOCK_SIZE},
+		{"blocks", 3*BLOCK_SIZE + 10},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			content := make([]byte, c.size)
+			for i := range content {
+				content[i] = byte(i%251 + 1)
+			}
+			thePath := filepath.Join(dir, c.name)
+			if err := os.WriteFile(thePath, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			info, _ := os.Lstat(thePath)
+			file, parts, err := m.readFile(thePath, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.FilePath != "/"+c.name || file.FileSize != c.size || file.FileHash != HashFile(thePath) {
+				t.Errorf("readFile = %+v", file)
+			}
+			want := int((c.size + BLOCK_SIZE - 1) / BLOCK_SIZE)
+			if len(parts) != want {
+				t.Fatalf("%d parts, want %d", len(parts), want)
+			}
+			var read []byte
+			for i, part := range parts {
+				if part.Seq != i || part.StartIndex != int64(i)*BLOCK_SIZE {
+					t.Errorf("part %d is %d at %d", i, part.Seq, part.StartIndex)
+				}
+				block := content[part.StartIndex : part.StartIndex+int64(part.Offset)]
+				if part.Checksum != fmt.Sprint(crc32.ChecksumIEEE(block)) || part.ChecksumType != "CRC32" {
+					t.Errorf("part %d has the checksum %s %s", i, part.ChecksumType, part.Checksum)
+				}
+				if sum := sha256.Sum256(block); part.StrongChecksum != hex.EncodeToString(sum[:]) {
+					t.Errorf("part %d has the strong checksum %s", i, part.StrongChecksum)
+				}
+				read = append(read, block...)
+			}
+			if !bytes.Equal(read, content) {
+				t.Error("the parts don't cover the file")
+			}
+		})
+	}
+}
+
+func TestWatchRecursively(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a/x.txt": "x", "a/y.txt": "y", "z.txt": "z"})
+	m := &Monitor{Monitored: root, Store: NewMemoryStore()}
+	defer m.Store.Close()
+	watcher := newPollWatcher(time.Hour)
+	defer watcher.Close()
+	if n, err := WatchRecursively(watcher, root, m); err != nil || n != 5 {
+		t.Fatalf("walked %d entries: %v", n, err)
+	}
+	y, _ := m.Store.File("/a/y.txt")
+
+	// changed while nothing watched
+	writeFiles(t, root, map[string]string{"a/x.txt": "changed", "b/new.txt": "new"})
+	os.Remove(filepath.Join(root, "z.txt"))
+	if _, err := WatchRecursively(watcher, root, m); err != nil {
+		t.Fatal(err)
+	}
+	for filePath, content := range map[string]string{"/a/x.txt": "changed", "/b/new.txt": "new"} {
+		file, _ := m.Store.File(filePath)
+		if file == nil || file.Status != "ready" || file.FileSize != int64(len(content)) {
+			t.Errorf("%s is indexed as %+v", filePath, file)
+		}
+		if parts, _ := m.Store.FileParts(filePath); len(parts) != 1 || parts[0].Checksum != fmt.Sprint(crc32.ChecksumIEEE([]byte(content))) {
+			t.Errorf("%s has the parts %+v", filePath, parts)
+		}
+	}
+	if file, _ := m.Store.File("/b/"); file == nil || file.FileSize != -1 {
+		t.Errorf("the new directory is indexed as %+v", file)
+	}
+	if file, _ := m.Store.File("/z.txt"); file == nil || file.Status != "deleted" {
+		t.Errorf("the removed file is indexed as %+v", file)
+	}
+	if file, _ := m.Store.File("/a/y.txt"); file == nil || file.LastIndexed != y.LastIndexed || file.FileHash != y.FileHash {
+		t.Errorf("the unchanged file was indexed again as %+v", file)
+	}
+}
+
+// sparseFile writes a file of 3 blocks and a bit, with data in the second
+// block only. It skips the test where the filesystem reports no holes.
+func sparseFile(t *testing.T, thePath string) []byte {
+	content := make([]byte, 3*BLOCK_SIZE+10)
+	copy(content[BLOCK_SIZE:], bytes.Repeat([]byte("data"), 100))
+	f, err := os.Create(thePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(content[BLOCK_SIZE:BLOCK_SIZE+400], BLOCK_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if len(holes(f, int64(len(content)))) == 0 {
+		t.Skip("the filesystem reports no holes")
+	}
+	return content
+}
+
+func TestHoles(t *testing.T) {
+	thePath := filepath.Join(t.TempDir(), "sparse")
+	content := sparseFile(t, thePath)
+	f, err := os.Open(thePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	found := holes(f, int64(len(content)))
+	// the data is allocated in pages, the holes end and start around it
+	if len(found) != 2 || found[0][0] != 0 || found[0][1] > BLOCK_SIZE || found[1][0] < BLOCK_SIZE+400 || found[1][1] != int64(len(content)) {
+		t.Fatalf("holes %v, want one before and one after the data at %d", found, BLOCK_SIZE)
+	}
+}
+
+func TestReadFileHoles(t *testing.T) {
+	dir := t.TempDir()
+	thePath := filepath.Join(dir, "sparse")
+	content := sparseFile(t, thePath)
+	m := &Monitor{Monitored: dir}
+	info, _ := os.Lstat(thePath)
+	file, parts, err := m.readFile(thePath, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.FileHash != HashFile(thePath) {
+		t.Error("the hash of the file leaves out its holes")
+	}
+	if len(parts) != 4 {
+		t.Fatalf("%d parts, want 4", len(parts))
+	}
+	for i, part := range parts {
+		block := content[part.StartIndex : part.StartIndex+int64(part.Offset)]
+		if part.Checksum != fmt.Sprint(crc32.ChecksumIEEE(block)) {
+			t.Errorf("part %d has the checksum %s", i, part.Checksum)
+		}
+		if hole := i != 1; hole != (part.ChecksumType == HOLE) || hole != (part.StrongChecksum == "") {
+			t.Errorf("part %d is %s %q", i, part.ChecksumType, part.StrongChecksum)
+		}
+	}
+}
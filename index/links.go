@@ -0,0 +1,109 @@
+package index
+
+import (
+	"os"
+	"time"
+)
+
+// putLinks brings the other indexed links of a file that was just put up to
+// date, as writing through one name changes them all but only that name gets
+// an event, then relinks the group.
+func putLinks(tx IndexTx, thePath string, indexed IndexedFile, parts []IndexedFilePart, m *Monitor) error {
+	members, err := linkMembers(tx, m, indexed.Device, indexed.Inode)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.FilePath == indexed.FilePath {
+			continue
+		}
+		linked := indexed
+		linked.FilePath = member.FilePath
+		linked.LinkedTo = member.LinkedTo
+		linked.MovedFrom, linked.MovedTo = member.MovedFrom, member.MovedTo
+		linked.LastIndexed = member.LastIndexed
+		if linked == member.IndexedFile {
+			continue
+		}
+		linked.LastIndexed = indexed.LastIndexed
+		linkedParts := make([]IndexedFilePart, len(parts))
+		for i, part := range parts {
+			part.FilePath = linked.FilePath
+			linkedParts[i] = part
+		}
+		if err := putParts(tx, linked.FilePath, linkedParts); err != nil {
+			return err
+		}
+		if err := tx.PutFile(linked); err != nil {
+			return err
+		}
+		if err := m.recordVersion(tx, linked, linkedParts); err != nil {
+			return err
+		}
+	}
+	return relink(tx, m, indexed.Device, indexed.Inode)
+}
+
+// relink sets LinkedTo on the indexed links of the file with device and
+// inode. They are linked to the first of them in path order once all of the
+// links of the file are indexed, a link outside the monitor leaves them to
+// be synced as separate files.
+func relink(tx IndexTx, m *Monitor, device uint64, inode uint64) error {
+	members, err := linkMembers(tx, m, device, inode)
+	if err != nil || len(members) == 0 {
+		return err
+	}
+	_, links := fileLinks(members[0].info)
+	first := ""
+	if uint64(len(members)) == links {
+		first = members[0].FilePath
+	}
+	now := time.Now().Unix()
+	for _, member := range members {
+		linkedTo := first
+		if member.FilePath == first {
+			linkedTo = ""
+		}
+		if member.LinkedTo == linkedTo && member.Links == links {
+			continue
+		}
+		member.LinkedTo = linkedTo
+		member.Links = links
+		member.LastIndexed = now
+		if err := tx.PutFile(member.IndexedFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type linkMember struct {
+	IndexedFile
+	info os.FileInfo
+}
+
+// linkMembers returns the ready records with device and inode whose path is
+// still a link of that file, in path order.
+func linkMembers(tx IndexTx, m *Monitor, device uint64, inode uint64) ([]linkMember, error) {
+	files, err := tx.FilesByInode(device, inode)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]linkMember, 0, len(files))
+	for _, file := range files {
+		if file.Status != "ready" || file.FileSize < 0 {
+			continue
+		}
+		info, err := os.Lstat(m.Monitored + file.FilePath)
+		if err != nil {
+			continue
+		}
+		_, fileInode := fileStat(info)
+		fileDevice, _ := fileLinks(info)
+		if fileInode != inode || fileDevice != device {
+			continue
+		}
+		members = append(members, linkMember{file, info})
+	}
+	return members, nil
+}
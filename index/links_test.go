@@ -0,0 +1,66 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinks(t *testing.T) {
+	root := t.TempDir()
+	m := &Monitor{Monitored: root, Store: NewMemoryStore()}
+	defer m.Store.Close()
+	writeFiles(t, root, map[string]string{"b": "hello"})
+	if err := os.Link(filepath.Join(root, "b"), filepath.Join(root, "a")); err != nil {
+		t.Skip(err)
+	}
+	info, _ := os.Lstat(filepath.Join(root, "b"))
+	if _, links := fileLinks(info); links != 2 {
+		t.Skip("the platform reports no links")
+	}
+	change := func(name string) {
+		thePath := filepath.Join(root, name)
+		info, _ := os.Lstat(thePath)
+		ProcessFileChange(m, thePath, info)
+	}
+	file := func(filePath string) IndexedFile {
+		file, _ := m.Store.File(filePath)
+		if file == nil {
+			t.Fatalf("%s isn't indexed", filePath)
+		}
+		return *file
+	}
+
+	// not linked until every link is indexed
+	change("b")
+	if b := file("/b"); b.Links != 2 || b.LinkedTo != "" {
+		t.Fatalf("with one link indexed /b is %+v", b)
+	}
+	change("a")
+	if a, b := file("/a"), file("/b"); a.LinkedTo != "" || b.LinkedTo != "/a" {
+		t.Fatalf("/a is %+v and /b %+v", a, b)
+	}
+
+	// written through one name, indexed under both
+	writeFiles(t, root, map[string]string{"a": "hello world"})
+	change("a")
+	b := file("/b")
+	parts, _ := m.Store.FileParts("/b")
+	if b.FileSize != 11 || b.FileHash != HashFile(filepath.Join(root, "b")) || len(parts) != 1 || b.LinkedTo != "/a" {
+		t.Errorf("/b is %+v with the parts %+v", b, parts)
+	}
+
+	// the first in path order is the one the others link to
+	os.Rename(filepath.Join(root, "a"), filepath.Join(root, "c"))
+	info, _ = os.Lstat(filepath.Join(root, "c"))
+	ProcessMove(m, filepath.Join(root, "a"), filepath.Join(root, "c"), info)
+	if b, c := file("/b"), file("/c"); b.LinkedTo != "" || c.LinkedTo != "/b" {
+		t.Errorf("after the move /b is %+v and /c %+v", b, c)
+	}
+
+	os.Remove(filepath.Join(root, "b"))
+	ProcessFileDelete(m, filepath.Join(root, "b"))
+	if c := file("/c"); c.LinkedTo != "" || c.Links != 1 {
+		t.Errorf("with one link left /c is %+v", c)
+	}
+}
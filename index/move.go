@@ -0,0 +1,204 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// MOVE_WINDOW is how long a path renamed away waits for its new name to be
+// created before it is indexed as deleted.
+const MOVE_WINDOW = 2 * time.Second
+
+// pendingMoves holds the records of paths renamed away, keyed by their old
+// path, until their new name shows up or MOVE_WINDOW passes.
+type pendingMoves map[string]pendingMove
+
+type pendingMove struct {
+	file     IndexedFile
+	deadline time.Time
+}
+
+// add remembers thePath as the source of a move. It reports false if the
+// path isn't indexed, in which case there is nothing to move.
+func (moves pendingMoves) add(store IndexStore, thePath string, monitored string) bool {
+	filePath := PathSafe(thePath)[len(monitored):]
+	for _, p := range []string{filePath, SlashSuffix(filePath)} {
+		file, err := store.File(p)
+		if err == nil && file != nil && file.Status == "ready" {
+			moves[thePath] = pendingMove{*file, time.Now().Add(MOVE_WINDOW)}
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the old path of the pending move that ended up at thePath,
+// or "" if there is none. A source matches by inode, or for a file that
+// changed inode on the way, by size and whole-file hash.
+func (moves pendingMoves) match(thePath string, info os.FileInfo) string {
+	_, inode := fileStat(info)
+	newHash := ""
+	for from, move := range moves {
+		if (move.file.FileSize == -1) != info.IsDir() {
+			continue
+		}
+		if inode != 0 && move.file.Inode == inode {
+			return from
+		}
+		if !info.IsDir() && move.file.FileSize == info.Size() && move.file.FileHash != "" {
+			if newHash == "" {
+				newHash = HashFile(thePath)
+			}
+			if newHash == move.file.FileHash {
+				return from
+			}
+		}
+	}
+	return ""
+}
+
+// expired removes and returns the old paths whose window has passed.
+func (moves pendingMoves) expired(now time.Time) []string {
+	result := make([]string, 0)
+	for from, move := range moves {
+		if !now.Before(move.deadline) {
+			result = append(result, from)
+			delete(moves, from)
+		}
+	}
+	return result
+}
+
+// timer returns a channel that fires when the earliest pending move
+// expires, or nil if nothing is pending.
+func (moves pendingMoves) timer() <-chan time.Time {
+	var next time.Time
+	for _, move := range moves {
+		if next.IsZero() || move.deadline.Before(next) {
+			next = move.deadline
+		}
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(next))
+}
+
+// ProcessMove records that oldPath was renamed to newPath. The records and
+// parts of the old path, and of everything below it for a directory, move to
+// the new path without being rehashed. The old record is kept as deleted
+// with MovedTo set and the new one gets MovedFrom, so clients can rename
+// their copy instead of downloading it again. Clients that don't know about
+// moves just see a delete and a new file.
+func ProcessMove(m *Monitor, oldPath string, newPath string, info os.FileInfo) {
+	err := inTx(m.Store, func(tx IndexTx) error {
+		return processMove(tx, oldPath, newPath, info, m)
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func processMove(tx IndexTx, oldPath string, newPath string, info os.FileInfo, m *Monitor) error {
+	oldPath, newPath = PathSafe(oldPath), PathSafe(newPath)
+	from, to := oldPath[len(m.Monitored):], newPath[len(m.Monitored):]
+	var files []IndexedFile
+	if info.IsDir() {
+		from, to = SlashSuffix(from), SlashSuffix(to)
+		var err error
+		if files, err = tx.FilesUnder(from); err != nil {
+			return err
+		}
+		if err := tx.DeleteUnder(to); err != nil {
+			return err
+		}
+	} else {
+		file, err := tx.File(from)
+		if err != nil || file == nil {
+			return err
+		}
+		files = []IndexedFile{*file}
+	}
+
+	now := time.Now().Unix()
+	var linked []IndexedFile
+	for _, file := range files {
+		if file.FilePath != from && file.Status != "ready" {
+			continue
+		}
+		moved := file
+		moved.FilePath = to + file.FilePath[len(from):]
+		moved.LastIndexed = now
+		moved.MovedFrom, moved.MovedTo = "", ""
+		if file.FilePath == from {
+			changedNs, inode := fileStat(info)
+			moved.Status = "ready"
+			moved.FileMode = info.Mode().Perm()
+			moved.LastModified = info.ModTime().Unix()
+			moved.ModifiedNs = info.ModTime().UnixNano()
+			moved.ChangedNs = changedNs
+			moved.Inode = inode
+			moved.MovedFrom = from
+		}
+		if err := tx.PutFile(moved); err != nil {
+			return err
+		}
+		if moved.Links > 1 {
+			linked = append(linked, moved)
+		}
+		if moved.FileSize < 0 {
+			continue
+		}
+		parts, err := tx.FileParts(file.FilePath)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteFileParts(moved.FilePath); err != nil {
+			return err
+		}
+		for i := range parts {
+			parts[i].FilePath = moved.FilePath
+			if err := tx.PutFilePart(parts[i]); err != nil {
+				return err
+			}
+		}
+		if err := m.recordVersion(tx, moved, parts); err != nil {
+			return err
+		}
+		file.Status = "deleted"
+		if err := m.recordVersion(tx, file, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.DeleteFileParts(from); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := tx.DeleteUnder(from); err != nil {
+			return err
+		}
+	}
+	old, err := tx.File(from)
+	if err != nil || old == nil {
+		return err
+	}
+	old.Status = "deleted"
+	old.LastIndexed = now
+	old.MovedFrom = ""
+	old.MovedTo = to
+	if err := tx.PutFile(*old); err != nil {
+		return err
+	}
+	for _, file := range linked {
+		// the first of the links may have changed
+		if err := relink(tx, m, file.Device, file.Inode); err != nil {
+			return err
+		}
+	}
+	if err := updateParentDir(tx, oldPath, m.Monitored); err != nil {
+		return err
+	}
+	return updateParentDir(tx, newPath, m.Monitored)
+}
@@ -0,0 +1,96 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestPendingMoves(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello", "d/f.txt": "f"})
+	m := &Monitor{Monitored: root, Store: NewMemoryStore()}
+	defer m.Store.Close()
+	if _, err := WatchRecursively(newChanWatcher(), root, m); err != nil {
+		t.Fatal(err)
+	}
+	moves := make(pendingMoves)
+	if moves.add(m.Store, filepath.Join(root, "missing"), root) || moves.timer() != nil {
+		t.Fatal("a path that isn't indexed is pending")
+	}
+
+	os.Rename(filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt"))
+	os.Rename(filepath.Join(root, "d"), filepath.Join(root, "e"))
+	for _, from := range []string{"a.txt", "d"} {
+		if !moves.add(m.Store, filepath.Join(root, from), root) {
+			t.Fatalf("%s isn't pending", from)
+		}
+	}
+	// a copy has another inode, its content tells where it came from
+	writeFiles(t, root, map[string]string{"copy.txt": "hello", "other.txt": "world"})
+	for to, from := range map[string]string{"b.txt": "a.txt", "e": "d", "copy.txt": "a.txt", "other.txt": ""} {
+		info, _ := os.Lstat(filepath.Join(root, to))
+		want := ""
+		if from != "" {
+			want = filepath.Join(root, from)
+		}
+		if matched := moves.match(filepath.Join(root, to), info); matched != want {
+			t.Errorf("%s matches %q, want %q", to, matched, want)
+		}
+	}
+
+	if expired := moves.expired(time.Now()); len(expired) != 0 || moves.timer() == nil {
+		t.Fatalf("%v expired within MOVE_WINDOW", expired)
+	}
+	if expired := moves.expired(time.Now().Add(MOVE_WINDOW)); len(expired) != 2 || len(moves) != 0 || moves.timer() != nil {
+		t.Fatalf("%v expired after MOVE_WINDOW, %v still pending", expired, moves)
+	}
+}
+
+func TestProcessEventMove(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a/b/f.txt": string(make([]byte, 3*BLOCK_SIZE)), "g.txt": "g"})
+	m := &Monitor{Monitored: root, Store: NewMemoryStore()}
+	defer m.Store.Close()
+	w := newChanWatcher()
+	if _, err := WatchRecursively(w, root, m); err != nil {
+		t.Fatal(err)
+	}
+	processEvents(t, w, m)
+	os.Rename(filepath.Join(root, "a", "b"), filepath.Join(root, "c"))
+	os.Rename(filepath.Join(root, "g.txt"), filepath.Join(root, "a", "h.txt"))
+	for _, ev := range []fsnotify.Event{
+		{Name: filepath.Join(root, "a", "b"), Op: fsnotify.Rename},
+		{Name: filepath.Join(root, "c"), Op: fsnotify.Create},
+		{Name: filepath.Join(root, "g.txt"), Op: fsnotify.Rename},
+		{Name: filepath.Join(root, "a", "h.txt"), Op: fsnotify.Create},
+		// taken once the events before are done with
+		{Name: root, Op: fsnotify.Chmod},
+	} {
+		w.events <- ev
+	}
+
+	for filePath, movedFrom := range map[string]string{"/c/": "/a/b/", "/a/h.txt": "/g.txt"} {
+		if file, _ := m.Store.File(filePath); file == nil || file.Status != "ready" || file.MovedFrom != movedFrom {
+			t.Errorf("%s is indexed as %+v", filePath, file)
+		}
+	}
+	for filePath, movedTo := range map[string]string{"/a/b/": "/c/", "/g.txt": "/a/h.txt"} {
+		if file, _ := m.Store.File(filePath); file == nil || file.Status != "deleted" || file.MovedTo != movedTo {
+			t.Errorf("%s is indexed as %+v", filePath, file)
+		}
+	}
+	// moved with its parts, not rehashed
+	if file, _ := m.Store.File("/c/f.txt"); file == nil || file.Status != "ready" {
+		t.Errorf("/c/f.txt is indexed as %+v", file)
+	}
+	if parts, _ := m.Store.FileParts("/c/f.txt"); len(parts) != 3 {
+		t.Errorf("/c/f.txt has %d parts", len(parts))
+	}
+	if file, _ := m.Store.File("/a/b/f.txt"); file != nil {
+		t.Errorf("/a/b/f.txt is still indexed as %+v", file)
+	}
+}
@@ -0,0 +1,149 @@
+package index
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PATROL_INTERVAL and PATROL_BATCH are the defaults for
+// Monitor.PatrolInterval and Monitor.PatrolBatch.
+const (
+	PATROL_INTERVAL = time.Minute
+	PATROL_BATCH    = 1000
+)
+
+// patrol catches the changes whose events were missed. Each tick walks the
+// next PatrolBatch entries of the tree, resuming where the previous tick
+// stopped, and queues the files whose stat doesn't match their record. It
+// then checks the next PatrolBatch records of the index for paths that are
+// gone. Files are only hashed when their stat changed.
+type patrol struct {
+	m       *Monitor
+	watcher Watcher
+	queue   *indexQueue
+	// walked is the walkKey of the last entry walked, checked the last
+	// record checked, "" to start over
+	walked  string
+	checked string
+}
+
+// patrolTicker returns a channel that fires every patrol interval of m, or
+// nil if m isn't patrolled, and the func that stops it. It is made once per
+// ProcessEvent, so a busy monitor is patrolled as often as an idle one.
+func (m *Monitor) patrolTicker() (<-chan time.Time, func()) {
+	if m.PatrolInterval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(m.PatrolInterval)
+	return ticker.C, ticker.Stop
+}
+
+// tick reports whether it removed records, changed files are left to the
+// queue.
+func (p *patrol) tick() bool {
+	batch := p.m.PatrolBatch
+	if batch < 1 {
+		batch = PATROL_BATCH
+	}
+	p.walk(batch)
+	return p.check(batch)
+}
+
+// walk looks at up to batch entries after p.walked.
+func (p *patrol) walk(batch int) {
+	m := p.m
+	count, last := 0, ""
+	filepath.WalkDir(m.Monitored, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isIndexPath(m, path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		thePath := PathSafe(path)
+		filePath := thePath[len(m.Monitored):]
+		if d.IsDir() {
+			filePath = SlashSuffix(filePath)
+		}
+		key := walkKey(filePath)
+		if p.walked != "" && key <= p.walked {
+			// walked by an earlier tick, unless it leads to where that
+			// one stopped
+			if d.IsDir() && !strings.HasPrefix(p.walked, key) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if count >= batch {
+			return filepath.SkipAll
+		}
+		count++
+		last = key
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		file, err := m.Store.File(filePath)
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			p.watcher.Add(path)
+			_, inode := fileStat(info)
+			if file == nil || file.Status != "ready" || file.Inode != inode {
+				// missed entirely, index it as a whole and go on after it
+				p.queue.rescan(path)
+				last = key + "\xff"
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if file == nil || !sameMetadata(file, info) {
+			p.queue.push(thePath)
+		}
+		return nil
+	})
+	if count < batch {
+		//fmt.Println("Patrolled", m.Monitored)
+		last = ""
+	}
+	p.walked = last
+}
+
+// check deletes the records of paths that are gone among up to batch
+// records after p.checked.
+func (p *patrol) check(batch int) bool {
+	files, err := p.m.Store.FilesAfter(p.checked, batch)
+	if err != nil {
+		return false
+	}
+	removed := false
+	for _, file := range files {
+		if file.Status != "ready" || file.FilePath == "/" {
+			continue
+		}
+		thePath := p.m.Monitored + strings.TrimSuffix(file.FilePath, "/")
+		if _, err := os.Lstat(thePath); os.IsNotExist(err) {
+			//fmt.Println("Zombie removed: ", file.FilePath)
+			ProcessFileDelete(p.m, thePath)
+			removed = true
+		}
+	}
+	p.checked = ""
+	if len(files) == batch {
+		p.checked = files[len(files)-1].FilePath
+	}
+	return removed
+}
+
+// walkKey orders paths the way filepath.WalkDir visits them: a directory
+// and everything below it before the names that follow it.
+func walkKey(filePath string) string {
+	return strings.Replace(filePath, "/", "\x00", -1)
+}
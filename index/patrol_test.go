@@ -0,0 +1,124 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// chanWatcher is a Watcher whose events are sent by the test.
+type chanWatcher struct {
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func newChanWatcher() *chanWatcher {
+	return &chanWatcher{events: make(chan fsnotify.Event), errors: make(chan error)}
+}
+
+func (w *chanWatcher) Add(dir string) error          { return nil }
+func (w *chanWatcher) Remove(dir string) error       { return nil }
+func (w *chanWatcher) Events() <-chan fsnotify.Event { return w.events }
+func (w *chanWatcher) Errors() <-chan error          { return w.errors }
+
+func (w *chanWatcher) Close() error {
+	close(w.events)
+	return nil
+}
+
+// processEvents runs ProcessEvent until the test ends.
+func processEvents(t *testing.T, w *chanWatcher, m *Monitor) {
+	done := make(chan struct{})
+	go func() {
+		ProcessEvent(w, m)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		w.Close()
+		<-done
+	})
+}
+
+func TestPatrolUnderEvents(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"busy.txt": "busy", "missed.txt": "missed"})
+	m := &Monitor{Monitored: root, Store: NewMemoryStore(), PatrolInterval: 100 * time.Millisecond}
+	defer m.Store.Close()
+	w := newChanWatcher()
+	if _, err := WatchRecursively(w, root, m); err != nil {
+		t.Fatal(err)
+	}
+	// changed without an event, only the patrol finds it
+	writeFiles(t, root, map[string]string{"missed.txt": "missed and changed"})
+	processEvents(t, w, m)
+
+	// an event far more often than the patrol interval
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w.events <- fsnotify.Event{Name: filepath.Join(root, "busy.txt"), Op: fsnotify.Chmod}
+		if file, _ := m.Store.File("/missed.txt"); file != nil && file.FileSize == int64(len("missed and changed")) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("the patrol never ran while events kept coming")
+}
+
+func TestPatrolResumes(t *testing.T) {
+	root := t.TempDir()
+	files := make(map[string]string)
+	for _, dir := range []string{"", "a", "a/b", "c"} {
+		for _, name := range []string{"f0", "f1", "f2"} {
+			files[filepath.Join(dir, name)] = "x"
+		}
+	}
+	files["a.txt"] = "x"
+	writeFiles(t, root, files)
+	m := &Monitor{Monitored: root, Store: NewMemoryStore(), PatrolBatch: 3}
+	defer m.Store.Close()
+	w := newChanWatcher()
+	if _, err := WatchRecursively(w, root, m); err != nil {
+		t.Fatal(err)
+	}
+	queue := newIndexQueue(m, w)
+	defer queue.close()
+	p := &patrol{m: m, watcher: w, queue: queue}
+
+	// nothing processes events, the patrol has to find these
+	writeFiles(t, root, map[string]string{"a/b/f1": "changed", "c/new": "new", "a/new/g": "g"})
+	os.Remove(filepath.Join(root, "a", "f2"))
+	os.Remove(filepath.Join(root, "c", "f0"))
+
+	ticks := 1
+	for p.tick(); p.walked != "" || p.checked != ""; p.tick() {
+		if ticks++; ticks > 50 {
+			t.Fatal("the patrol never got through the tree")
+		}
+	}
+	if ticks < 2 {
+		t.Error("patrolled the whole tree in one tick of 3")
+	}
+	for queue.busy() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for filePath, size := range map[string]int64{"/a/b/f1": 7, "/c/new": 3, "/a/new/": -1, "/a/new/g": 1, "/a.txt": 1} {
+		if file, _ := m.Store.File(filePath); file == nil || file.Status != "ready" || file.FileSize != size {
+			t.Errorf("%s is indexed as %+v", filePath, file)
+		}
+	}
+	for _, filePath := range []string{"/a/f2", "/c/f0"} {
+		if file, _ := m.Store.File(filePath); file == nil || file.Status != "deleted" {
+			t.Errorf("%s is indexed as %+v", filePath, file)
+		}
+	}
+}
+
+func TestWalkKey(t *testing.T) {
+	// filepath.WalkDir visits /a/ and what is in it before /a.txt
+	if !(walkKey("/a/") < walkKey("/a/b")) || !(walkKey("/a/b") < walkKey("/a.txt")) {
+		t.Fatal("walkKey doesn't order paths the way they are walked")
+	}
+}
@@ -0,0 +1,228 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// INDEX_WORKERS and INDEX_QUEUE_SIZE are the defaults for Monitor.Workers
+// and Monitor.QueueSize.
+const (
+	INDEX_WORKERS    = 4
+	INDEX_QUEUE_SIZE = 10000
+)
+
+// QueueStats are the metrics of the indexing queue of a monitor, served by
+// the api at /metrics.
+type QueueStats struct {
+	// Depth is the number of paths waiting for a worker, MaxDepth the
+	// highest it has been.
+	Depth    int
+	MaxDepth int
+	// Active is the number of paths being indexed right now.
+	Active int
+	// Indexed counts the paths taken off the queue, Merged the changes to a
+	// path that was queued already, and Folded the changes that found the
+	// queue full and were queued as a rescan of their directory instead.
+	Indexed int64
+	Merged  int64
+	Folded  int64
+	// Overflows counts the times the kernel dropped events, WatcherErrors
+	// the other errors of the watcher. Each of them rescans the monitor.
+	Overflows     int64
+	WatcherErrors int64
+}
+
+// indexQueue hands the files that changed to a pool of workers that hash
+// them. A path is queued at most once however often it changes, and never
+// indexed by two workers at the same time. Pushing never blocks, so events
+// keep being read while the workers are busy and the kernel queue behind
+// fsnotify doesn't overflow. Once QueueSize paths are waiting, a change is
+// queued as a rescan of its directory, which is queued once for any number
+// of changes in it, so the queue stays bounded by the directories.
+type indexQueue struct {
+	m       *Monitor
+	watcher Watcher
+	size    int
+	mu      sync.Mutex
+	cond    *sync.Cond
+	order   []string        // waiting paths, oldest first
+	queued  map[string]bool // waiting paths, true for a directory rescan
+	active  map[string]bool // paths being indexed
+	again   map[string]bool // active paths changed since they were taken
+	closed  bool
+	workers sync.WaitGroup
+	// done is signaled when a worker finished a path
+	done  chan struct{}
+	stats QueueStats
+}
+
+// newIndexQueue starts the workers indexing m.
+func newIndexQueue(m *Monitor, watcher Watcher) *indexQueue {
+	workers, size := m.Workers, m.QueueSize
+	if workers < 1 {
+		workers = INDEX_WORKERS
+	}
+	if size < 1 {
+		size = INDEX_QUEUE_SIZE
+	}
+	q := &indexQueue{
+		m:       m,
+		watcher: watcher,
+		size:    size,
+		queued:  make(map[string]bool),
+		active:  make(map[string]bool),
+		again:   make(map[string]bool),
+		done:    make(chan struct{}, 1),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// push queues the file thePath to be indexed.
+func (q *indexQueue) push(thePath string) {
+	q.queue(thePath, false)
+}
+
+// rescan queues the directory dir to be scanned with WatchRecursively.
+func (q *indexQueue) rescan(dir string) {
+	q.queue(dir, true)
+}
+
+func (q *indexQueue) queue(thePath string, rescan bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.queued[thePath]; !ok && !rescan && len(q.order) >= q.size {
+		thePath, rescan = filepath.Dir(thePath), true
+		q.stats.Folded++
+	}
+	if _, ok := q.queued[thePath]; ok {
+		q.stats.Merged++
+		return
+	}
+	if q.active[thePath] {
+		q.again[thePath] = q.again[thePath] || rescan
+		return
+	}
+	q.add(thePath, rescan)
+}
+
+func (q *indexQueue) add(thePath string, rescan bool) {
+	q.queued[thePath] = rescan
+	q.order = append(q.order, thePath)
+	q.stats.Depth = len(q.order)
+	if q.stats.Depth > q.stats.MaxDepth {
+		q.stats.MaxDepth = q.stats.Depth
+	}
+	q.cond.Signal()
+}
+
+// next waits for a path and marks it active. It returns false once the
+// queue is closed.
+func (q *indexQueue) next() (string, bool, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.order) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return "", false, false
+	}
+	thePath := q.order[0]
+	q.order = q.order[1:]
+	rescan := q.queued[thePath]
+	delete(q.queued, thePath)
+	q.active[thePath] = true
+	q.stats.Depth = len(q.order)
+	q.stats.Active = len(q.active)
+	return thePath, rescan, true
+}
+
+// finish marks thePath done, it is queued again if it changed meanwhile.
+func (q *indexQueue) finish(thePath string) {
+	q.mu.Lock()
+	delete(q.active, thePath)
+	if rescan, ok := q.again[thePath]; ok {
+		delete(q.again, thePath)
+		q.add(thePath, rescan)
+	}
+	q.stats.Indexed++
+	q.stats.Active = len(q.active)
+	q.mu.Unlock()
+	select {
+	case q.done <- struct{}{}:
+	default:
+	}
+}
+
+func (q *indexQueue) work() {
+	defer q.workers.Done()
+	for {
+		thePath, rescan, ok := q.next()
+		if !ok {
+			return
+		}
+		if rescan {
+			if _, err := WatchRecursively(q.watcher, thePath, q.m); err != nil {
+				fmt.Println(err)
+			}
+		} else if info, err := os.Lstat(thePath); err == nil && !info.IsDir() {
+			ProcessFileChange(q.m, thePath, info)
+		}
+		q.finish(thePath)
+	}
+}
+
+// lost notes that the watcher failed with err, so events may have been
+// missed, and queues a rescan of the whole monitor.
+func (q *indexQueue) lost(err error) {
+	q.mu.Lock()
+	if errors.Is(err, fsnotify.ErrEventOverflow) {
+		q.stats.Overflows++
+	} else {
+		q.stats.WatcherErrors++
+	}
+	q.mu.Unlock()
+	fmt.Printf("Watching %s failed: %v, rescanning it\n", q.m.Monitored, err)
+	q.rescan(PathSafe(q.m.Monitored))
+}
+
+// busy reports whether paths are waiting or being indexed.
+func (q *indexQueue) busy() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.order) > 0 || len(q.active) > 0
+}
+
+// close stops the workers and waits until they are done with their current
+// path, the paths still waiting are dropped.
+func (q *indexQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+	q.workers.Wait()
+}
+
+// QueueStats returns the metrics of the indexing queue of m, zero before
+// ProcessEvent started it.
+func (m *Monitor) QueueStats() QueueStats {
+	m.mu.Lock()
+	q := m.queue
+	m.mu.Unlock()
+	if q == nil {
+		return QueueStats{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
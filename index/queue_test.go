@@ -0,0 +1,54 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// waitIndexed waits until filePath is indexed with status and size.
+func waitIndexed(t *testing.T, m *Monitor, filePath string, status string, size int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if file, _ := m.Store.File(filePath); file != nil && file.Status == status && file.FileSize == size {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	file, _ := m.Store.File(filePath)
+	t.Fatalf("%s is indexed as %+v", filePath, file)
+}
+
+func TestWatcherLost(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a/kept": "kept", "gone": "gone"})
+	m := &Monitor{Monitored: root, Store: NewMemoryStore()}
+	defer m.Store.Close()
+	w := newChanWatcher()
+	if _, err := WatchRecursively(w, root, m); err != nil {
+		t.Fatal(err)
+	}
+	processEvents(t, w, m)
+
+	// the events of these were dropped
+	writeFiles(t, root, map[string]string{"a/missed": "missed", "new/deep": "deep"})
+	os.Remove(filepath.Join(root, "gone"))
+	w.errors <- fsnotify.ErrEventOverflow
+	waitIndexed(t, m, "/a/missed", "ready", 6)
+	waitIndexed(t, m, "/new/deep", "ready", 4)
+	waitIndexed(t, m, "/gone", "deleted", 4)
+	if stats := m.QueueStats(); stats.Overflows != 1 || stats.WatcherErrors != 0 {
+		t.Errorf("QueueStats = %+v after an overflow", stats)
+	}
+
+	writeFiles(t, root, map[string]string{"other": "other"})
+	w.errors <- errors.New("watcher failed")
+	waitIndexed(t, m, "/other", "ready", 5)
+	if stats := m.QueueStats(); stats.Overflows != 1 || stats.WatcherErrors != 1 {
+		t.Errorf("QueueStats = %+v after an error", stats)
+	}
+}
@@ -0,0 +1,198 @@
+package index
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// migrations upgrade index.db one schema version at a time: migrations[i]
+// takes the schema from version i to version i+1. Released migrations must
+// never change, new ones are appended to the end.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: FILES and FILE_PARTS as created by the first release
+	func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS FILE_PARTS(
+				FILE_PATH TEXT NOT NULL,
+				SEQ INTEGER NOT NULL,
+				START_INDEX INTEGER NOT NULL,
+				OFFSET INTEGER NOT NULL,
+				CHECKSUM TEXT NOT NULL,
+				CHECKSUM_TYPE TEXT NOT NULL,
+				PRIMARY KEY(FILE_PATH, SEQ)
+			);`,
+			`CREATE TABLE IF NOT EXISTS FILES(
+				FILE_PATH TEXT PRIMARY KEY,
+				LAST_MODIFIED INTEGER NOT NULL,
+				FILE_SIZE INTEGER NOT NULL,
+				FILE_MODE INTEGER NOT NULL,
+				STATUS TEXT NOT NULL,
+				LAST_INDEXED INTEGER NOT NULL
+			);`,
+			"CREATE INDEX IF NOT EXISTS IDX_FILES_FILESIZE ON FILES(FILE_SIZE);",
+			"CREATE INDEX IF NOT EXISTS IDX_FILES_STATUS ON FILES(STATUS);",
+			"CREATE INDEX IF NOT EXISTS IDX_FILES_LASTINDEXED ON FILES(LAST_INDEXED);",
+		)
+	},
+	// 2: nanosecond mtime, ctime, inode and content hash. Files indexed before
+	// have no nanosecond mtime and are rehashed on the next scan.
+	func(tx *sql.Tx) error {
+		return addColumns(tx, "FILES",
+			"MODIFIED_NS INTEGER NOT NULL DEFAULT 0",
+			"CHANGED_NS INTEGER NOT NULL DEFAULT 0",
+			"INODE INTEGER NOT NULL DEFAULT 0",
+			"FILE_HASH TEXT NOT NULL DEFAULT ''",
+		)
+	},
+	// 3: move records, see ProcessMove
+	func(tx *sql.Tx) error {
+		return addColumns(tx, "FILES",
+			"MOVED_FROM TEXT NOT NULL DEFAULT ''",
+			"MOVED_TO TEXT NOT NULL DEFAULT ''",
+		)
+	},
+	// 4: sha256 of each part, filled in as files are rehashed
+	func(tx *sql.Tx) error {
+		return addColumns(tx, "FILE_PARTS",
+			"STRONG_CHECKSUM TEXT NOT NULL DEFAULT ''",
+		)
+	},
+	// 5: file history, see FileVersion
+	func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS FILE_VERSIONS(
+				FILE_PATH TEXT NOT NULL,
+				VERSION_TIME INTEGER NOT NULL,
+				LAST_MODIFIED INTEGER NOT NULL,
+				FILE_SIZE INTEGER NOT NULL,
+				FILE_MODE INTEGER NOT NULL,
+				STATUS TEXT NOT NULL,
+				FILE_HASH TEXT NOT NULL,
+				PRIMARY KEY(FILE_PATH, VERSION_TIME)
+			);`,
+			`CREATE TABLE IF NOT EXISTS VERSION_PARTS(
+				FILE_PATH TEXT NOT NULL,
+				VERSION_TIME INTEGER NOT NULL,
+				SEQ INTEGER NOT NULL,
+				START_INDEX INTEGER NOT NULL,
+				OFFSET INTEGER NOT NULL,
+				CHECKSUM TEXT NOT NULL,
+				CHECKSUM_TYPE TEXT NOT NULL,
+				STRONG_CHECKSUM TEXT NOT NULL,
+				PRIMARY KEY(FILE_PATH, VERSION_TIME, SEQ)
+			);`,
+		)
+	},
+	// 6: the latest generation, see Generation
+	func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS GENERATIONS(
+				SEQ INTEGER PRIMARY KEY,
+				GENERATION_TIME INTEGER NOT NULL
+			);`,
+		)
+	},
+	// 7: hard links, see IndexedFile.LinkedTo
+	func(tx *sql.Tx) error {
+		if err := addColumns(tx, "FILES",
+			"DEVICE INTEGER NOT NULL DEFAULT 0",
+			"LINKS INTEGER NOT NULL DEFAULT 0",
+			"LINKED_TO TEXT NOT NULL DEFAULT ''",
+		); err != nil {
+			return err
+		}
+		return execAll(tx, "CREATE INDEX IF NOT EXISTS FILES_INODE ON FILES(INODE, DEVICE);")
+	},
+	// 8: empty files have no parts, drop the empty part they used to get
+	func(tx *sql.Tx) error {
+		return execAll(tx,
+			"DELETE FROM FILE_PARTS WHERE OFFSET=0;",
+			"DELETE FROM VERSION_PARTS WHERE OFFSET=0;",
+		)
+	},
+}
+
+// SCHEMA_VERSION is the index.db schema version written by this build.
+var SCHEMA_VERSION = len(migrations)
+
+// InitIndex creates or upgrades the index.db in indexPath to SCHEMA_VERSION.
+// Pending migrations run in a single transaction after the existing
+// database has been backed up next to it. A database written by a newer
+// version is refused.
+func InitIndex(indexPath string, db *sql.DB) error {
+	dbPath := filepath.Join(indexPath, "index.db")
+	if err := os.MkdirAll(indexPath, (os.FileMode)(0755)); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS SCHEMA_VERSION(VERSION INTEGER NOT NULL);"); err != nil {
+		return err
+	}
+	version := 0
+	err := db.QueryRow("SELECT VERSION FROM SCHEMA_VERSION").Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if version > SCHEMA_VERSION {
+		return fmt.Errorf("%s has schema version %d, this build only supports up to %d", dbPath, version, SCHEMA_VERSION)
+	}
+	if version == SCHEMA_VERSION {
+		return nil
+	}
+
+	var tables int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='FILES'").Scan(&tables)
+	if tables > 0 {
+		backup := fmt.Sprint(dbPath, ".v", version, ".", time.Now().Unix(), ".bak")
+		if _, err := db.Exec("VACUUM INTO ?", backup); err != nil {
+			return fmt.Errorf("backing up %s: %v", dbPath, err)
+		}
+		fmt.Println("Backed up", dbPath, "to", backup)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := version; i < SCHEMA_VERSION; i++ {
+		if err := migrations[i](tx); err != nil {
+			return fmt.Errorf("migrating %s to schema version %d: %v", dbPath, i+1, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM SCHEMA_VERSION"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO SCHEMA_VERSION(VERSION) VALUES(?)", SCHEMA_VERSION); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if version > 0 || tables > 0 {
+		fmt.Println("Migrated", dbPath, "from schema version", version, "to", SCHEMA_VERSION)
+	}
+	return nil
+}
+
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumns adds columns to table. Each migration runs in the transaction
+// that records the new version, so it never finds its columns added.
+func addColumns(tx *sql.Tx, table string, columns ...string) error {
+	for _, column := range columns {
+		if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
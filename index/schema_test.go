@@ -0,0 +1,130 @@
+//go:build cgo
+
+package index
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openIndexDB(t *testing.T, dir string) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func backups(t *testing.T, dir string) []string {
+	found, err := filepath.Glob(filepath.Join(dir, "index.db.v*.bak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	version := 0
+	if err := db.QueryRow("SELECT VERSION FROM SCHEMA_VERSION").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestInitIndexFresh(t *testing.T) {
+	dir := t.TempDir()
+	db := openIndexDB(t, dir)
+	for i := 0; i < 2; i++ {
+		if err := InitIndex(dir, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if version := schemaVersion(t, db); version != SCHEMA_VERSION {
+		t.Errorf("schema version %d, want %d", version, SCHEMA_VERSION)
+	}
+	if found := backups(t, dir); len(found) > 0 {
+		t.Errorf("backed up a new database to %v", found)
+	}
+}
+
+func TestInitIndexMigrates(t *testing.T) {
+	dir := t.TempDir()
+	db := openIndexDB(t, dir)
+	// an index.db of the first release, which had no SCHEMA_VERSION
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations[0](tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := execAll(tx,
+		"INSERT INTO FILES VALUES('/a.txt', 1, 3, 420, 'ready', 2);",
+		"INSERT INTO FILE_PARTS VALUES('/a.txt', 0, 0, 3, '1', 'CRC32');",
+		"INSERT INTO FILES VALUES('/empty', 1, 0, 420, 'ready', 2);",
+		"INSERT INTO FILE_PARTS VALUES('/empty', 0, 0, 0, '0', 'CRC32');",
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitIndex(dir, db); err != nil {
+		t.Fatal(err)
+	}
+	if version := schemaVersion(t, db); version != SCHEMA_VERSION {
+		t.Errorf("schema version %d, want %d", version, SCHEMA_VERSION)
+	}
+	var filePath, linkedTo string
+	if err := db.QueryRow("SELECT FILE_PATH, LINKED_TO FROM FILES WHERE FILE_PATH='/a.txt'").Scan(&filePath, &linkedTo); err != nil {
+		t.Errorf("the file indexed before the migration: %v", err)
+	}
+	var parts int
+	db.QueryRow("SELECT COUNT(*) FROM FILE_PARTS").Scan(&parts)
+	if parts != 1 {
+		t.Errorf("%d parts after the migration, want the empty file's dropped", parts)
+	}
+
+	found := backups(t, dir)
+	if len(found) != 1 || !strings.HasPrefix(filepath.Base(found[0]), "index.db.v0.") {
+		t.Fatalf("backups %v, want one of version 0", found)
+	}
+	backup, err := sql.Open("sqlite3", found[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	var files int
+	if err := backup.QueryRow("SELECT COUNT(*) FROM FILES").Scan(&files); err != nil || files != 2 {
+		t.Errorf("the backup holds %d files: %v", files, err)
+	}
+
+	// nothing left to migrate, nothing to back up
+	if err := InitIndex(dir, db); err != nil {
+		t.Fatal(err)
+	}
+	if found := backups(t, dir); len(found) != 1 {
+		t.Errorf("backups %v after a second start", found)
+	}
+}
+
+func TestInitIndexNewer(t *testing.T) {
+	dir := t.TempDir()
+	db := openIndexDB(t, dir)
+	if err := InitIndex(dir, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE SCHEMA_VERSION SET VERSION=?", SCHEMA_VERSION+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitIndex(dir, db); err == nil {
+		t.Fatal("opened a database of a newer schema")
+	}
+	if version := schemaVersion(t, db); version != SCHEMA_VERSION+1 {
+		t.Errorf("schema version %d after refusing it", version)
+	}
+}
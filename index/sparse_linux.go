@@ -0,0 +1,31 @@
+package index
+
+import (
+	"os"
+)
+
+// lseek whences that find the data and the holes of a sparse file.
+const (
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
+
+// holes returns the holes of f, which is size bytes long, as [start, end)
+// ranges in order. Filesystems that don't track holes report none.
+func holes(f *os.File, size int64) [][2]int64 {
+	result := make([][2]int64, 0)
+	for offset := int64(0); offset < size; {
+		hole, err := f.Seek(offset, SEEK_HOLE)
+		if err != nil || hole >= size {
+			break
+		}
+		data, err := f.Seek(hole, SEEK_DATA)
+		if err != nil || data > size {
+			// no data after the hole
+			data = size
+		}
+		result = append(result, [2]int64{hole, data})
+		offset = data
+	}
+	return result
+}
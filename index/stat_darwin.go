@@ -0,0 +1,24 @@
+package index
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileStat returns the ctime in nanoseconds and the inode number of info.
+func fileStat(info os.FileInfo) (int64, uint64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return st.Ctimespec.Sec*1e9 + st.Ctimespec.Nsec, st.Ino
+}
+
+// fileLinks returns the device and the number of hard links of info.
+func fileLinks(info os.FileInfo) (uint64, uint64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Dev), uint64(st.Nlink)
+}
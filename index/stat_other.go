@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package index
+
+import (
+	"os"
+)
+
+// fileStat returns zeros where the platform doesn't expose ctime and inode,
+// so change detection falls back to mtime, size and mode.
+func fileStat(info os.FileInfo) (int64, uint64) {
+	return 0, 0
+}
+
+// fileLinks returns zeros, hard links aren't recognized here.
+func fileLinks(info os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
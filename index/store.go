@@ -0,0 +1,184 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IndexStore keeps the index of one monitored directory: the FILES records,
+// their FILE_PARTS, and the change feed clients poll through the api.
+// Paths are relative to the monitored directory, directories end with "/".
+type IndexStore interface {
+	// File returns the record of filePath, or nil if it isn't indexed.
+	File(filePath string) (*IndexedFile, error)
+	// FilesUnder returns every record whose path starts with prefix.
+	FilesUnder(prefix string) ([]IndexedFile, error)
+	// FilesAfter returns up to limit records whose path sorts after
+	// filePath, in path order.
+	FilesAfter(filePath string, limit int) ([]IndexedFile, error)
+	// FileParts returns the parts of filePath ordered by Seq.
+	FileParts(filePath string) ([]IndexedFilePart, error)
+	// ChangedDirs returns the directories indexed after lastIndexed.
+	ChangedDirs(lastIndexed int64) ([]IndexedFile, error)
+	// ChangedFiles returns the files under prefix indexed after lastIndexed,
+	// leaving out the ones still being updated.
+	ChangedFiles(lastIndexed int64, prefix string) ([]IndexedFile, error)
+	// BlockRefs returns how many parts, of files and of versions, reference
+	// each StrongChecksum.
+	BlockRefs() (map[string]int, error)
+	// Versions returns the versions of filePath, the newest first.
+	Versions(filePath string) ([]FileVersion, error)
+	// VersionsAt returns, for every file under prefix that existed at time
+	// at, the version it had then.
+	VersionsAt(prefix string, at int64) ([]FileVersion, error)
+	// VersionParts returns the parts of the version of filePath recorded at
+	// versionTime, ordered by Seq.
+	VersionParts(filePath string, versionTime int64) ([]IndexedFilePart, error)
+	// Generation returns the latest generation, the zero Generation if there
+	// is none yet.
+	Generation() (Generation, error)
+	// Begin starts a write transaction. Only one is open at a time, Begin
+	// blocks until the previous one has been committed or rolled back.
+	Begin() (IndexTx, error)
+	// Path returns the directory holding the index on disk, or "" if the
+	// store keeps nothing on disk.
+	Path() string
+	Close() error
+}
+
+// IndexTx is a write transaction on an IndexStore. Reads through the
+// transaction see its own uncommitted writes.
+type IndexTx interface {
+	File(filePath string) (*IndexedFile, error)
+	FilesUnder(prefix string) ([]IndexedFile, error)
+	// FilesByInode returns the records of the hard links to a file, in path
+	// order.
+	FilesByInode(device uint64, inode uint64) ([]IndexedFile, error)
+	FileParts(filePath string) ([]IndexedFilePart, error)
+	// PutFile inserts or replaces the record of file.FilePath.
+	PutFile(file IndexedFile) error
+	// PutFilePart inserts or replaces part number part.Seq of part.FilePath.
+	PutFilePart(part IndexedFilePart) error
+	// TruncateFileParts removes the parts of filePath from seq on.
+	TruncateFileParts(filePath string, seq int) error
+	// DeleteFileParts removes all parts of filePath.
+	DeleteFileParts(filePath string) error
+	// DeleteUnder removes the records and parts of everything below dirPath,
+	// keeping the record of dirPath itself.
+	DeleteUnder(dirPath string) error
+	Versions(filePath string) ([]FileVersion, error)
+	// PutVersion inserts or replaces the version of version.FilePath
+	// recorded at version.VersionTime together with its parts.
+	PutVersion(version FileVersion, parts []IndexedFilePart) error
+	// PruneVersions removes the versions of the files under prefix recorded
+	// before before, except the keep newest of each file.
+	PruneVersions(prefix string, keep int, before int64) error
+	// PutGeneration makes generation the latest one.
+	PutGeneration(generation Generation) error
+	// Savepoint runs fn atomically within the transaction. If fn fails, its
+	// writes are undone and the transaction stays usable.
+	Savepoint(fn func() error) error
+	// Commit and Rollback end the transaction, on one that has ended they
+	// return sql.ErrTxDone.
+	Commit() error
+	Rollback() error
+}
+
+var storeOpeners = make(map[string]func(indexPath string) (IndexStore, error))
+
+func registerStore(kind string, open func(indexPath string) (IndexStore, error)) {
+	storeOpeners[kind] = open
+}
+
+// OpenStore opens the index kept in the directory indexPath with the named
+// backend, "sqlite" or "memory". An empty kind is sqlite, memory has to be
+// asked for as it forgets the index, and the deletes clients haven't seen
+// yet, on restart.
+func OpenStore(kind string, indexPath string) (IndexStore, error) {
+	if kind == "" {
+		kind = "sqlite"
+	}
+	open, ok := storeOpeners[kind]
+	if !ok {
+		if kind == "sqlite" {
+			return nil, fmt.Errorf("index store sqlite is not available, the binary was built without cgo, set index_store to memory to keep the index in memory")
+		}
+		return nil, fmt.Errorf("unknown index store %q", kind)
+	}
+	return open(indexPath)
+}
+
+// IndexPath returns the directory holding the index of share, which is
+// monitored at monitored. A configured path always wins. Otherwise an index
+// already present in the legacy <monitored>/.sync keeps being used, and new
+// ones go to $XDG_STATE_HOME/gsyncd/<share>.
+func IndexPath(share string, monitored string, configured string) string {
+	if configured != "" {
+		return configured
+	}
+	legacy := SlashSuffix(monitored) + ".sync"
+	stateDir := filepath.Join(stateHome(), "gsyncd", strings.Replace(share, "/", "_", -1))
+	if exists(legacy+"/index.db") && !exists(stateDir+"/index.db") {
+		fmt.Println("Using the index in", legacy, "set index_path to move it out of the monitored directory.")
+		return legacy
+	}
+	return stateDir
+}
+
+func stateHome() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return os.TempDir()
+	}
+	return filepath.Join(home, ".local", "state")
+}
+
+// isIndexPath reports whether thePath is the index directory or the block
+// store of m or lies inside one of them, so scans don't index the index.
+func isIndexPath(m *Monitor, thePath string) bool {
+	if within(m.Store.Path(), thePath) {
+		return true
+	}
+	return m.Blocks != nil && within(m.Blocks.dir, thePath)
+}
+
+// within reports whether thePath is dir or lies inside it.
+func within(dir string, thePath string) bool {
+	if dir == "" {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(thePath)
+	if err != nil {
+		return false
+	}
+	return absPath == absDir || strings.HasPrefix(absPath, SlashSuffix(absDir))
+}
+
+// inTx runs fn in a transaction on store and commits it unless fn fails.
+func inTx(store IndexStore, fn func(tx IndexTx) error) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func sortFiles(files []IndexedFile) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FilePath < files[j].FilePath
+	})
+}
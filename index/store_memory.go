@@ -0,0 +1,493 @@
+package index
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func init() {
+	registerStore("memory", func(indexPath string) (IndexStore, error) {
+		return NewMemoryStore(), nil
+	})
+}
+
+// memoryStore is a pure Go IndexStore that keeps everything in process. It
+// needs neither cgo nor disk, which suits tests, but nothing survives a
+// restart: the index is rebuilt by the startup scan. Lookups by prefix walk
+// the whole map.
+type memoryStore struct {
+	mu           sync.RWMutex // guards files, parts, versions and versionParts
+	writer       sync.Mutex   // held by the open transaction
+	files        map[string]IndexedFile
+	parts        map[string][]IndexedFilePart
+	versions     map[string][]FileVersion // newest first
+	versionParts map[versionKey][]IndexedFilePart
+	generation   Generation
+}
+
+type versionKey struct {
+	filePath    string
+	versionTime int64
+}
+
+// NewMemoryStore returns an empty in-memory IndexStore.
+func NewMemoryStore() IndexStore {
+	return &memoryStore{
+		files:        make(map[string]IndexedFile),
+		parts:        make(map[string][]IndexedFilePart),
+		versions:     make(map[string][]FileVersion),
+		versionParts: make(map[versionKey][]IndexedFilePart),
+	}
+}
+
+func (store *memoryStore) File(filePath string) (*IndexedFile, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if file, ok := store.files[filePath]; ok {
+		return &file, nil
+	}
+	return nil, nil
+}
+
+func (store *memoryStore) FilesUnder(prefix string) ([]IndexedFile, error) {
+	return store.selectFiles(func(file *IndexedFile) bool {
+		return strings.HasPrefix(file.FilePath, prefix)
+	}), nil
+}
+
+func (store *memoryStore) FilesAfter(filePath string, limit int) ([]IndexedFile, error) {
+	files := store.selectFiles(func(file *IndexedFile) bool {
+		return file.FilePath > filePath
+	})
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	return files, nil
+}
+
+func (store *memoryStore) FileParts(filePath string) ([]IndexedFilePart, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return append([]IndexedFilePart(nil), store.parts[filePath]...), nil
+}
+
+func (store *memoryStore) ChangedDirs(lastIndexed int64) ([]IndexedFile, error) {
+	return store.selectFiles(func(file *IndexedFile) bool {
+		return file.FileSize == -1 && file.LastIndexed > lastIndexed
+	}), nil
+}
+
+func (store *memoryStore) ChangedFiles(lastIndexed int64, prefix string) ([]IndexedFile, error) {
+	return store.selectFiles(func(file *IndexedFile) bool {
+		return file.LastIndexed > lastIndexed && file.FileSize >= 0 && file.Status != "updating" &&
+			strings.HasPrefix(file.FilePath, prefix)
+	}), nil
+}
+
+func (store *memoryStore) BlockRefs() (map[string]int, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	result := make(map[string]int)
+	for _, parts := range store.parts {
+		for _, part := range parts {
+			if part.StrongChecksum != "" {
+				result[part.StrongChecksum]++
+			}
+		}
+	}
+	for _, parts := range store.versionParts {
+		for _, part := range parts {
+			if part.StrongChecksum != "" {
+				result[part.StrongChecksum]++
+			}
+		}
+	}
+	return result, nil
+}
+
+func (store *memoryStore) Versions(filePath string) ([]FileVersion, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return append([]FileVersion(nil), store.versions[filePath]...), nil
+}
+
+func (store *memoryStore) VersionsAt(prefix string, at int64) ([]FileVersion, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	result := make([]FileVersion, 0)
+	for filePath, versions := range store.versions {
+		if !strings.HasPrefix(filePath, prefix) {
+			continue
+		}
+		for _, version := range versions {
+			if version.VersionTime <= at {
+				if version.Status == "ready" {
+					result = append(result, version)
+				}
+				break
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FilePath < result[j].FilePath
+	})
+	return result, nil
+}
+
+func (store *memoryStore) VersionParts(filePath string, versionTime int64) ([]IndexedFilePart, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return append([]IndexedFilePart(nil), store.versionParts[versionKey{filePath, versionTime}]...), nil
+}
+
+func (store *memoryStore) selectFiles(match func(file *IndexedFile) bool) []IndexedFile {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	result := make([]IndexedFile, 0)
+	for _, file := range store.files {
+		if match(&file) {
+			result = append(result, file)
+		}
+	}
+	sortFiles(result)
+	return result
+}
+
+func (store *memoryStore) Generation() (Generation, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.generation, nil
+}
+
+func (store *memoryStore) Begin() (IndexTx, error) {
+	store.writer.Lock()
+	return &memoryTx{
+		store:        store,
+		files:        make(map[string]*IndexedFile),
+		parts:        make(map[string][]IndexedFilePart),
+		versions:     make(map[string][]FileVersion),
+		versionParts: make(map[versionKey][]IndexedFilePart),
+	}, nil
+}
+
+func (store *memoryStore) Path() string {
+	return ""
+}
+
+func (store *memoryStore) Close() error {
+	return nil
+}
+
+// memoryTx collects its writes in an overlay that is applied to the store on
+// Commit, so readers never see a half written file. Every write records how
+// to undo itself, which is what Savepoint rolls back.
+type memoryTx struct {
+	store        *memoryStore
+	files        map[string]*IndexedFile          // nil: deleted
+	parts        map[string][]IndexedFilePart     // nil: no parts
+	versions     map[string][]FileVersion         // nil: no versions
+	versionParts map[versionKey][]IndexedFilePart // nil: no parts
+	generation   *Generation                      // nil: unchanged
+	undo         []func()
+	done         bool
+}
+
+func (tx *memoryTx) File(filePath string) (*IndexedFile, error) {
+	if file, ok := tx.files[filePath]; ok {
+		if file == nil {
+			return nil, nil
+		}
+		copied := *file
+		return &copied, nil
+	}
+	return tx.store.File(filePath)
+}
+
+func (tx *memoryTx) FilesUnder(prefix string) ([]IndexedFile, error) {
+	files, _ := tx.store.FilesUnder(prefix)
+	result := make([]IndexedFile, 0, len(files))
+	for _, file := range files {
+		if _, ok := tx.files[file.FilePath]; !ok {
+			result = append(result, file)
+		}
+	}
+	for filePath, file := range tx.files {
+		if file != nil && strings.HasPrefix(filePath, prefix) {
+			result = append(result, *file)
+		}
+	}
+	sortFiles(result)
+	return result, nil
+}
+
+func (tx *memoryTx) FilesByInode(device uint64, inode uint64) ([]IndexedFile, error) {
+	files := tx.store.selectFiles(func(file *IndexedFile) bool {
+		return file.Inode == inode && file.Device == device
+	})
+	result := make([]IndexedFile, 0, len(files))
+	for _, file := range files {
+		if _, ok := tx.files[file.FilePath]; !ok {
+			result = append(result, file)
+		}
+	}
+	for _, file := range tx.files {
+		if file != nil && file.Inode == inode && file.Device == device {
+			result = append(result, *file)
+		}
+	}
+	sortFiles(result)
+	return result, nil
+}
+
+func (tx *memoryTx) FileParts(filePath string) ([]IndexedFilePart, error) {
+	if parts, ok := tx.parts[filePath]; ok {
+		return append([]IndexedFilePart(nil), parts...), nil
+	}
+	return tx.store.FileParts(filePath)
+}
+
+func (tx *memoryTx) setFile(filePath string, file *IndexedFile) {
+	prev, had := tx.files[filePath]
+	tx.undo = append(tx.undo, func() {
+		if had {
+			tx.files[filePath] = prev
+		} else {
+			delete(tx.files, filePath)
+		}
+	})
+	tx.files[filePath] = file
+}
+
+func (tx *memoryTx) setParts(filePath string, parts []IndexedFilePart) {
+	prev, had := tx.parts[filePath]
+	tx.undo = append(tx.undo, func() {
+		if had {
+			tx.parts[filePath] = prev
+		} else {
+			delete(tx.parts, filePath)
+		}
+	})
+	tx.parts[filePath] = parts
+}
+
+func (tx *memoryTx) setVersions(filePath string, versions []FileVersion) {
+	prev, had := tx.versions[filePath]
+	tx.undo = append(tx.undo, func() {
+		if had {
+			tx.versions[filePath] = prev
+		} else {
+			delete(tx.versions, filePath)
+		}
+	})
+	tx.versions[filePath] = versions
+}
+
+func (tx *memoryTx) setVersionParts(key versionKey, parts []IndexedFilePart) {
+	prev, had := tx.versionParts[key]
+	tx.undo = append(tx.undo, func() {
+		if had {
+			tx.versionParts[key] = prev
+		} else {
+			delete(tx.versionParts, key)
+		}
+	})
+	tx.versionParts[key] = parts
+}
+
+func (tx *memoryTx) PutFile(file IndexedFile) error {
+	tx.setFile(file.FilePath, &file)
+	return nil
+}
+
+func (tx *memoryTx) PutFilePart(part IndexedFilePart) error {
+	parts, _ := tx.FileParts(part.FilePath)
+	i := sort.Search(len(parts), func(i int) bool {
+		return parts[i].Seq >= part.Seq
+	})
+	if i < len(parts) && parts[i].Seq == part.Seq {
+		parts[i] = part
+	} else {
+		parts = append(parts, IndexedFilePart{})
+		copy(parts[i+1:], parts[i:])
+		parts[i] = part
+	}
+	tx.setParts(part.FilePath, parts)
+	return nil
+}
+
+func (tx *memoryTx) TruncateFileParts(filePath string, seq int) error {
+	parts, _ := tx.FileParts(filePath)
+	kept := make([]IndexedFilePart, 0, len(parts))
+	for _, part := range parts {
+		if part.Seq < seq {
+			kept = append(kept, part)
+		}
+	}
+	tx.setParts(filePath, kept)
+	return nil
+}
+
+func (tx *memoryTx) DeleteFileParts(filePath string) error {
+	tx.setParts(filePath, nil)
+	return nil
+}
+
+func (tx *memoryTx) DeleteUnder(dirPath string) error {
+	under := func(filePath string) bool {
+		return filePath != dirPath && strings.HasPrefix(filePath, dirPath)
+	}
+	filePaths := make(map[string]bool)
+	tx.store.mu.RLock()
+	for filePath := range tx.store.files {
+		filePaths[filePath] = true
+	}
+	for filePath := range tx.store.parts {
+		filePaths[filePath] = true
+	}
+	tx.store.mu.RUnlock()
+	for filePath := range tx.files {
+		filePaths[filePath] = true
+	}
+	for filePath := range tx.parts {
+		filePaths[filePath] = true
+	}
+	for filePath := range filePaths {
+		if under(filePath) {
+			tx.setFile(filePath, nil)
+			tx.setParts(filePath, nil)
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) Versions(filePath string) ([]FileVersion, error) {
+	if versions, ok := tx.versions[filePath]; ok {
+		return append([]FileVersion(nil), versions...), nil
+	}
+	return tx.store.Versions(filePath)
+}
+
+func (tx *memoryTx) PutVersion(version FileVersion, parts []IndexedFilePart) error {
+	versions, _ := tx.Versions(version.FilePath)
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].VersionTime <= version.VersionTime
+	})
+	if i < len(versions) && versions[i].VersionTime == version.VersionTime {
+		versions[i] = version
+	} else {
+		versions = append(versions, FileVersion{})
+		copy(versions[i+1:], versions[i:])
+		versions[i] = version
+	}
+	tx.setVersions(version.FilePath, versions)
+	tx.setVersionParts(versionKey{version.FilePath, version.VersionTime}, append([]IndexedFilePart(nil), parts...))
+	return nil
+}
+
+func (tx *memoryTx) PruneVersions(prefix string, keep int, before int64) error {
+	filePaths := make(map[string]bool)
+	tx.store.mu.RLock()
+	for filePath := range tx.store.versions {
+		filePaths[filePath] = true
+	}
+	tx.store.mu.RUnlock()
+	for filePath := range tx.versions {
+		filePaths[filePath] = true
+	}
+	for filePath := range filePaths {
+		if !strings.HasPrefix(filePath, prefix) {
+			continue
+		}
+		versions, _ := tx.Versions(filePath)
+		kept := make([]FileVersion, 0, len(versions))
+		for i, version := range versions {
+			if i < keep || version.VersionTime >= before {
+				kept = append(kept, version)
+			} else {
+				tx.setVersionParts(versionKey{filePath, version.VersionTime}, nil)
+			}
+		}
+		if len(kept) < len(versions) {
+			tx.setVersions(filePath, kept)
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) PutGeneration(generation Generation) error {
+	prev := tx.generation
+	tx.undo = append(tx.undo, func() {
+		tx.generation = prev
+	})
+	tx.generation = &generation
+	return nil
+}
+
+func (tx *memoryTx) Savepoint(fn func() error) error {
+	mark := len(tx.undo)
+	if err := fn(); err != nil {
+		for i := len(tx.undo) - 1; i >= mark; i-- {
+			tx.undo[i]()
+		}
+		tx.undo = tx.undo[:mark]
+		return err
+	}
+	return nil
+}
+
+func (tx *memoryTx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.store.mu.Lock()
+	for filePath, file := range tx.files {
+		if file == nil {
+			delete(tx.store.files, filePath)
+		} else {
+			tx.store.files[filePath] = *file
+		}
+	}
+	for filePath, parts := range tx.parts {
+		if len(parts) == 0 {
+			delete(tx.store.parts, filePath)
+		} else {
+			tx.store.parts[filePath] = parts
+		}
+	}
+	for filePath, versions := range tx.versions {
+		if len(versions) == 0 {
+			delete(tx.store.versions, filePath)
+		} else {
+			tx.store.versions[filePath] = versions
+		}
+	}
+	for key, parts := range tx.versionParts {
+		if len(parts) == 0 {
+			delete(tx.store.versionParts, key)
+		} else {
+			tx.store.versionParts[key] = parts
+		}
+	}
+	if tx.generation != nil {
+		tx.store.generation = *tx.generation
+	}
+	tx.store.mu.Unlock()
+	tx.finish()
+	return nil
+}
+
+func (tx *memoryTx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.finish()
+	return nil
+}
+
+func (tx *memoryTx) finish() {
+	tx.done = true
+	tx.files, tx.parts, tx.versions, tx.versionParts, tx.generation, tx.undo = nil, nil, nil, nil, nil, nil
+	tx.store.writer.Unlock()
+}
@@ -0,0 +1,384 @@
+//go:build cgo
+
+package index
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	registerStore("sqlite", openSqliteStore)
+}
+
+// FILE_COLUMNS lists the columns of FILES in the order scanFile reads them.
+const FILE_COLUMNS = "FILE_PATH,LAST_MODIFIED,FILE_SIZE,FILE_MODE,STATUS,LAST_INDEXED,MODIFIED_NS,CHANGED_NS,INODE,FILE_HASH,MOVED_FROM,MOVED_TO,DEVICE,LINKS,LINKED_TO"
+
+// FILE_PART_COLUMNS lists the columns of FILE_PARTS in the order scanFilePart reads them.
+const FILE_PART_COLUMNS = "FILE_PATH,SEQ,START_INDEX,OFFSET,CHECKSUM,CHECKSUM_TYPE,STRONG_CHECKSUM"
+
+// FILE_VERSION_COLUMNS lists the columns of FILE_VERSIONS in the order scanFileVersion reads them.
+const FILE_VERSION_COLUMNS = "FILE_PATH,VERSION_TIME,LAST_MODIFIED,FILE_SIZE,FILE_MODE,STATUS,FILE_HASH"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFile(row rowScanner, file *IndexedFile) error {
+	return row.Scan(&file.FilePath, &file.LastModified, &file.FileSize, &file.FileMode, &file.Status,
+		&file.LastIndexed, &file.ModifiedNs, &file.ChangedNs, &file.Inode, &file.FileHash, &file.MovedFrom, &file.MovedTo,
+		&file.Device, &file.Links, &file.LinkedTo)
+}
+
+func scanFilePart(row rowScanner, filePart *IndexedFilePart) error {
+	return row.Scan(&filePart.FilePath, &filePart.Seq, &filePart.StartIndex, &filePart.Offset,
+		&filePart.Checksum, &filePart.ChecksumType, &filePart.StrongChecksum)
+}
+
+func scanFileVersion(row rowScanner, version *FileVersion) error {
+	return row.Scan(&version.FilePath, &version.VersionTime, &version.LastModified, &version.FileSize,
+		&version.FileMode, &version.Status, &version.FileHash)
+}
+
+// prefixRange returns the bounds of the FILE_PATH range starting with
+// prefix, so prefix lookups can use the primary key.
+func prefixRange(prefix string) (string, string) {
+	return prefix, prefix + string(rune(0x10FFFF))
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func queryFile(q queryer, filePath string) (*IndexedFile, error) {
+	file := new(IndexedFile)
+	err := scanFile(q.QueryRow("SELECT "+FILE_COLUMNS+" FROM FILES WHERE FILE_PATH=?", filePath), file)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func queryFiles(q queryer, query string, args ...interface{}) ([]IndexedFile, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]IndexedFile, 0)
+	for rows.Next() {
+		file := new(IndexedFile)
+		if err := scanFile(rows, file); err != nil {
+			return nil, err
+		}
+		result = append(result, *file)
+	}
+	return result, rows.Err()
+}
+
+func queryFileParts(q queryer, filePath string) ([]IndexedFilePart, error) {
+	return queryParts(q, "SELECT "+FILE_PART_COLUMNS+" FROM FILE_PARTS WHERE FILE_PATH=? ORDER BY SEQ", filePath)
+}
+
+func queryParts(q queryer, query string, args ...interface{}) ([]IndexedFilePart, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]IndexedFilePart, 0)
+	for rows.Next() {
+		filePart := new(IndexedFilePart)
+		if err := scanFilePart(rows, filePart); err != nil {
+			return nil, err
+		}
+		result = append(result, *filePart)
+	}
+	return result, rows.Err()
+}
+
+func queryVersions(q queryer, query string, args ...interface{}) ([]FileVersion, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]FileVersion, 0)
+	for rows.Next() {
+		version := new(FileVersion)
+		if err := scanFileVersion(rows, version); err != nil {
+			return nil, err
+		}
+		result = append(result, *version)
+	}
+	return result, rows.Err()
+}
+
+// sqliteStore keeps the index in <indexPath>/index.db. It needs cgo.
+type sqliteStore struct {
+	db        *sql.DB
+	indexPath string
+	// writer is held by the open transaction. sqlite allows a single writer
+	// anyway, waiting here keeps a transaction that read first from failing
+	// with SQLITE_BUSY when it starts to write.
+	writer sync.Mutex
+}
+
+func openSqliteStore(indexPath string) (IndexStore, error) {
+	if err := os.MkdirAll(indexPath, (os.FileMode)(0755)); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(indexPath, "index.db")+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if err := InitIndex(indexPath, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, indexPath: indexPath}, nil
+}
+
+func (store *sqliteStore) File(filePath string) (*IndexedFile, error) {
+	return queryFile(store.db, filePath)
+}
+
+func (store *sqliteStore) FilesUnder(prefix string) ([]IndexedFile, error) {
+	from, to := prefixRange(prefix)
+	return queryFiles(store.db, "SELECT "+FILE_COLUMNS+" FROM FILES WHERE FILE_PATH>=? AND FILE_PATH<?", from, to)
+}
+
+func (store *sqliteStore) FilesAfter(filePath string, limit int) ([]IndexedFile, error) {
+	return queryFiles(store.db, "SELECT "+FILE_COLUMNS+" FROM FILES WHERE FILE_PATH>? ORDER BY FILE_PATH LIMIT ?", filePath, limit)
+}
+
+func (store *sqliteStore) FileParts(filePath string) ([]IndexedFilePart, error) {
+	return queryFileParts(store.db, filePath)
+}
+
+func (store *sqliteStore) ChangedDirs(lastIndexed int64) ([]IndexedFile, error) {
+	return queryFiles(store.db, "SELECT "+FILE_COLUMNS+" FROM FILES WHERE FILE_SIZE=-1 AND LAST_INDEXED>?", lastIndexed)
+}
+
+func (store *sqliteStore) ChangedFiles(lastIndexed int64, prefix string) ([]IndexedFile, error) {
+	from, to := prefixRange(prefix)
+	return queryFiles(store.db, `SELECT `+FILE_COLUMNS+` FROM FILES
+				WHERE LAST_INDEXED>? AND FILE_SIZE>=0 AND STATUS!='updating' AND FILE_PATH>=? AND FILE_PATH<?`,
+		lastIndexed, from, to)
+}
+
+func (store *sqliteStore) BlockRefs() (map[string]int, error) {
+	rows, err := store.db.Query(`SELECT STRONG_CHECKSUM,COUNT(*) FROM
+		(SELECT STRONG_CHECKSUM FROM FILE_PARTS UNION ALL SELECT STRONG_CHECKSUM FROM VERSION_PARTS)
+		WHERE STRONG_CHECKSUM!='' GROUP BY STRONG_CHECKSUM`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]int)
+	for rows.Next() {
+		var hash string
+		var count int
+		if err := rows.Scan(&hash, &count); err != nil {
+			return nil, err
+		}
+		result[hash] = count
+	}
+	return result, rows.Err()
+}
+
+func (store *sqliteStore) Versions(filePath string) ([]FileVersion, error) {
+	return queryVersions(store.db, "SELECT "+FILE_VERSION_COLUMNS+" FROM FILE_VERSIONS WHERE FILE_PATH=? ORDER BY VERSION_TIME DESC", filePath)
+}
+
+func (store *sqliteStore) VersionsAt(prefix string, at int64) ([]FileVersion, error) {
+	from, to := prefixRange(prefix)
+	return queryVersions(store.db, `SELECT `+FILE_VERSION_COLUMNS+` FROM FILE_VERSIONS V
+				WHERE FILE_PATH>=? AND FILE_PATH<? AND STATUS='ready' AND VERSION_TIME=
+				(SELECT MAX(VERSION_TIME) FROM FILE_VERSIONS WHERE FILE_PATH=V.FILE_PATH AND VERSION_TIME<=?)
+				ORDER BY FILE_PATH`, from, to, at)
+}
+
+func (store *sqliteStore) VersionParts(filePath string, versionTime int64) ([]IndexedFilePart, error) {
+	return queryParts(store.db, "SELECT "+FILE_PART_COLUMNS+" FROM VERSION_PARTS WHERE FILE_PATH=? AND VERSION_TIME=? ORDER BY SEQ",
+		filePath, versionTime)
+}
+
+func (store *sqliteStore) Generation() (Generation, error) {
+	var generation Generation
+	err := store.db.QueryRow("SELECT SEQ,GENERATION_TIME FROM GENERATIONS ORDER BY SEQ DESC LIMIT 1").Scan(&generation.Seq, &generation.Time)
+	if err == sql.ErrNoRows {
+		return generation, nil
+	}
+	return generation, err
+}
+
+func (store *sqliteStore) Begin() (IndexTx, error) {
+	store.writer.Lock()
+	tx, err := store.db.Begin()
+	if err != nil {
+		store.writer.Unlock()
+		return nil, err
+	}
+	return &sqliteTx{tx: tx, store: store}, nil
+}
+
+func (store *sqliteStore) Path() string {
+	return store.indexPath
+}
+
+func (store *sqliteStore) Close() error {
+	return store.db.Close()
+}
+
+type sqliteTx struct {
+	tx    *sql.Tx
+	store *sqliteStore
+}
+
+func (tx *sqliteTx) File(filePath string) (*IndexedFile, error) {
+	return queryFile(tx.tx, filePath)
+}
+
+func (tx *sqliteTx) FilesUnder(prefix string) ([]IndexedFile, error) {
+	from, to := prefixRange(prefix)
+	return queryFiles(tx.tx, "SELECT "+FILE_COLUMNS+" FROM FILES WHERE FILE_PATH>=? AND FILE_PATH<?", from, to)
+}
+
+func (tx *sqliteTx) FilesByInode(device uint64, inode uint64) ([]IndexedFile, error) {
+	return queryFiles(tx.tx, "SELECT "+FILE_COLUMNS+" FROM FILES WHERE INODE=? AND DEVICE=? ORDER BY FILE_PATH", inode, device)
+}
+
+func (tx *sqliteTx) FileParts(filePath string) ([]IndexedFilePart, error) {
+	return queryFileParts(tx.tx, filePath)
+}
+
+func (tx *sqliteTx) PutFile(file IndexedFile) error {
+	_, err := tx.tx.Exec(`INSERT OR REPLACE INTO FILES
+	(`+FILE_COLUMNS+`)
+	VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`, file.FilePath, file.LastModified, file.FileSize, file.FileMode, file.Status,
+		file.LastIndexed, file.ModifiedNs, file.ChangedNs, file.Inode, file.FileHash, file.MovedFrom, file.MovedTo,
+		file.Device, file.Links, file.LinkedTo)
+	return err
+}
+
+func (tx *sqliteTx) PutFilePart(part IndexedFilePart) error {
+	_, err := tx.tx.Exec(`INSERT OR REPLACE INTO FILE_PARTS
+	(`+FILE_PART_COLUMNS+`)
+	VALUES(?,?,?,?,?,?,?)`, part.FilePath, part.Seq, part.StartIndex, part.Offset, part.Checksum, part.ChecksumType,
+		part.StrongChecksum)
+	return err
+}
+
+func (tx *sqliteTx) TruncateFileParts(filePath string, seq int) error {
+	_, err := tx.tx.Exec("DELETE FROM FILE_PARTS WHERE FILE_PATH=? AND SEQ>=?", filePath, seq)
+	return err
+}
+
+func (tx *sqliteTx) DeleteFileParts(filePath string) error {
+	_, err := tx.tx.Exec("DELETE FROM FILE_PARTS WHERE FILE_PATH=?", filePath)
+	return err
+}
+
+func (tx *sqliteTx) DeleteUnder(dirPath string) error {
+	from, to := prefixRange(dirPath)
+	if _, err := tx.tx.Exec("DELETE FROM FILE_PARTS WHERE FILE_PATH>? AND FILE_PATH<?", from, to); err != nil {
+		return err
+	}
+	_, err := tx.tx.Exec("DELETE FROM FILES WHERE FILE_PATH>? AND FILE_PATH<?", from, to)
+	return err
+}
+
+func (tx *sqliteTx) Versions(filePath string) ([]FileVersion, error) {
+	return queryVersions(tx.tx, "SELECT "+FILE_VERSION_COLUMNS+" FROM FILE_VERSIONS WHERE FILE_PATH=? ORDER BY VERSION_TIME DESC", filePath)
+}
+
+func (tx *sqliteTx) PutVersion(version FileVersion, parts []IndexedFilePart) error {
+	_, err := tx.tx.Exec(`INSERT OR REPLACE INTO FILE_VERSIONS
+	(`+FILE_VERSION_COLUMNS+`)
+	VALUES(?,?,?,?,?,?,?)`, version.FilePath, version.VersionTime, version.LastModified, version.FileSize,
+		version.FileMode, version.Status, version.FileHash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.tx.Exec("DELETE FROM VERSION_PARTS WHERE FILE_PATH=? AND VERSION_TIME=?", version.FilePath, version.VersionTime)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		_, err := tx.tx.Exec(`INSERT INTO VERSION_PARTS
+		(VERSION_TIME,`+FILE_PART_COLUMNS+`)
+		VALUES(?,?,?,?,?,?,?,?)`, version.VersionTime, version.FilePath, part.Seq, part.StartIndex, part.Offset,
+			part.Checksum, part.ChecksumType, part.StrongChecksum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *sqliteTx) PruneVersions(prefix string, keep int, before int64) error {
+	from, to := prefixRange(prefix)
+	_, err := tx.tx.Exec(`DELETE FROM FILE_VERSIONS WHERE rowid IN
+		(SELECT ID FROM (SELECT rowid AS ID, VERSION_TIME,
+			ROW_NUMBER() OVER (PARTITION BY FILE_PATH ORDER BY VERSION_TIME DESC) AS RANK
+			FROM FILE_VERSIONS WHERE FILE_PATH>=? AND FILE_PATH<?)
+		WHERE RANK>? AND VERSION_TIME<?)`, from, to, keep, before)
+	if err != nil {
+		return err
+	}
+	_, err = tx.tx.Exec(`DELETE FROM VERSION_PARTS WHERE FILE_PATH>=? AND FILE_PATH<? AND NOT EXISTS
+		(SELECT 1 FROM FILE_VERSIONS V WHERE V.FILE_PATH=VERSION_PARTS.FILE_PATH AND V.VERSION_TIME=VERSION_PARTS.VERSION_TIME)`,
+		from, to)
+	return err
+}
+
+func (tx *sqliteTx) PutGeneration(generation Generation) error {
+	if _, err := tx.tx.Exec("DELETE FROM GENERATIONS"); err != nil {
+		return err
+	}
+	_, err := tx.tx.Exec("INSERT INTO GENERATIONS(SEQ,GENERATION_TIME) VALUES(?,?)", generation.Seq, generation.Time)
+	return err
+}
+
+func (tx *sqliteTx) Savepoint(fn func() error) error {
+	if _, err := tx.tx.Exec("SAVEPOINT ENTRY"); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		tx.tx.Exec("ROLLBACK TO ENTRY")
+		tx.tx.Exec("RELEASE ENTRY")
+		return err
+	}
+	_, err := tx.tx.Exec("RELEASE ENTRY")
+	return err
+}
+
+func (tx *sqliteTx) Commit() error {
+	err := tx.tx.Commit()
+	tx.finish(err)
+	return err
+}
+
+func (tx *sqliteTx) Rollback() error {
+	err := tx.tx.Rollback()
+	tx.finish(err)
+	return err
+}
+
+// finish releases the writer once the transaction is over, a Commit or
+// Rollback that failed because it already was over doesn't release it again.
+func (tx *sqliteTx) finish(err error) {
+	if err != sql.ErrTxDone {
+		tx.store.writer.Unlock()
+	}
+}
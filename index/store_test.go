@@ -0,0 +1,232 @@
+package index
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The memory store needs no disk, so these run anywhere. They hold for
+// every IndexStore.
+
+func TestOpenStoreMemory(t *testing.T) {
+	store, err := OpenStore("memory", "/nonexistent/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Path() != "" {
+		t.Fatalf("Path() = %q, the memory store keeps nothing on disk", store.Path())
+	}
+	if _, err := OpenStore("bogus", ""); err == nil {
+		t.Fatal("an unknown store opened")
+	}
+}
+
+func TestStoreChanges(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	tx, err := store.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []IndexedFile{
+		{FilePath: "/", FileSize: -1, Status: "ready", LastIndexed: 10},
+		{FilePath: "/a/", FileSize: -1, Status: "ready", LastIndexed: 20},
+		{FilePath: "/a/x.txt", FileSize: 3, Status: "ready", LastIndexed: 20},
+		{FilePath: "/a/y.txt", FileSize: 3, Status: "updating", LastIndexed: 30},
+		{FilePath: "/b.txt", FileSize: 3, Status: "deleted", LastIndexed: 30},
+	} {
+		if err := tx.PutFile(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, _ := store.ChangedDirs(10)
+	if len(dirs) != 1 || dirs[0].FilePath != "/a/" {
+		t.Errorf("ChangedDirs(10) = %v, want /a/", dirs)
+	}
+	// files being updated aren't reported, deleted ones are
+	files, _ := store.ChangedFiles(0, "/")
+	if paths := filePaths(files); len(paths) != 2 || !paths["/a/x.txt"] || !paths["/b.txt"] {
+		t.Errorf("ChangedFiles(0, /) = %v, want /a/x.txt and /b.txt", files)
+	}
+	files, _ = store.ChangedFiles(0, "/a/")
+	if len(files) != 1 || files[0].FilePath != "/a/x.txt" {
+		t.Errorf("ChangedFiles(0, /a/) = %v, want /a/x.txt", files)
+	}
+	after, _ := store.FilesAfter("/a/", 2)
+	if len(after) != 2 || after[0].FilePath != "/a/x.txt" || after[1].FilePath != "/a/y.txt" {
+		t.Errorf("FilesAfter(/a/, 2) = %v", after)
+	}
+}
+
+func TestStoreTx(t *testing.T) {
+	for _, kind := range []string{"memory", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			store, err := OpenStore(kind, t.TempDir())
+			if err != nil {
+				t.Skip(err)
+			}
+			defer store.Close()
+			testStoreTx(t, store)
+		})
+	}
+}
+
+func testStoreTx(t *testing.T, store IndexStore) {
+	tx, _ := store.Begin()
+	tx.PutFile(IndexedFile{FilePath: "/a/", FileSize: -1, Status: "ready"})
+	tx.PutFile(IndexedFile{FilePath: "/a/x.txt", FileSize: 2 * BLOCK_SIZE, Status: "ready"})
+	tx.PutFilePart(IndexedFilePart{FilePath: "/a/x.txt", Seq: 0, Offset: int(BLOCK_SIZE)})
+	tx.PutFilePart(IndexedFilePart{FilePath: "/a/x.txt", Seq: 1, StartIndex: BLOCK_SIZE, Offset: int(BLOCK_SIZE)})
+	// reads see the writes of the transaction, others don't before commit
+	if file, _ := tx.File("/a/x.txt"); file == nil {
+		t.Fatal("the transaction doesn't see its own write")
+	}
+	if file, _ := store.File("/a/x.txt"); file != nil {
+		t.Fatal("an uncommitted write is visible")
+	}
+	// a failed savepoint is undone, the transaction goes on
+	failed := errors.New("failed")
+	err := tx.Savepoint(func() error {
+		tx.PutFile(IndexedFile{FilePath: "/a/z.txt", Status: "ready"})
+		tx.TruncateFileParts("/a/x.txt", 1)
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Savepoint returned %v", err)
+	}
+	if file, _ := tx.File("/a/z.txt"); file != nil {
+		t.Error("the write of a failed savepoint is kept")
+	}
+	if parts, _ := tx.FileParts("/a/x.txt"); len(parts) != 2 {
+		t.Errorf("%d parts after a failed savepoint, want 2", len(parts))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ = store.Begin()
+	tx.PutFile(IndexedFile{FilePath: "/gone.txt", Status: "ready"})
+	tx.Rollback()
+	if file, _ := store.File("/gone.txt"); file != nil {
+		t.Error("a rolled back write is visible")
+	}
+
+	// a transaction ends once, the same way on every store
+	if err := tx.Commit(); err != sql.ErrTxDone {
+		t.Errorf("Commit after Rollback returned %v", err)
+	}
+	if err := tx.Rollback(); err != sql.ErrTxDone {
+		t.Errorf("Rollback after Rollback returned %v", err)
+	}
+
+	tx, _ = store.Begin()
+	if err := tx.DeleteUnder("/a/"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	if err := tx.Commit(); err != sql.ErrTxDone {
+		t.Errorf("Commit after Commit returned %v", err)
+	}
+	if file, _ := store.File("/a/"); file == nil {
+		t.Error("DeleteUnder removed the directory itself")
+	}
+	if file, _ := store.File("/a/x.txt"); file != nil {
+		t.Error("DeleteUnder kept a file below the directory")
+	}
+	if parts, _ := store.FileParts("/a/x.txt"); len(parts) != 0 {
+		t.Errorf("DeleteUnder kept %d parts", len(parts))
+	}
+}
+
+func TestStoreVersions(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	tx, _ := store.Begin()
+	for _, versionTime := range []int64{100, 200, 300} {
+		version := FileVersion{FilePath: "/x.txt", VersionTime: versionTime, Status: "ready"}
+		parts := []IndexedFilePart{{FilePath: "/x.txt", Offset: 1, StrongChecksum: "block"}}
+		if err := tx.PutVersion(version, parts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Commit()
+
+	versions, _ := store.Versions("/x.txt")
+	if len(versions) != 3 || versions[0].VersionTime != 300 {
+		t.Fatalf("Versions = %v, want 3 newest first", versions)
+	}
+	at, _ := store.VersionsAt("/", 250)
+	if len(at) != 1 || at[0].VersionTime != 200 {
+		t.Errorf("VersionsAt(/, 250) = %v, want the version of 200", at)
+	}
+	if refs, _ := store.BlockRefs(); refs["block"] != 3 {
+		t.Errorf("BlockRefs = %v, want 3 references to block", refs)
+	}
+
+	tx, _ = store.Begin()
+	if err := tx.PruneVersions("/", 1, 250); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	versions, _ = store.Versions("/x.txt")
+	if len(versions) != 1 || versions[0].VersionTime != 300 {
+		t.Errorf("Versions after pruning = %v, want the one of 300", versions)
+	}
+	if parts, _ := store.VersionParts("/x.txt", 100); len(parts) != 0 {
+		t.Errorf("the parts of a pruned version are kept")
+	}
+}
+
+func TestIndexPath(t *testing.T) {
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+	monitored := t.TempDir()
+	legacy := filepath.Join(monitored, ".sync")
+	stateDir := filepath.Join(state, "gsyncd", "a_b")
+
+	if indexPath := IndexPath("a/b", monitored, "/configured"); indexPath != "/configured" {
+		t.Errorf("IndexPath = %s, want the configured path", indexPath)
+	}
+	if indexPath := IndexPath("a/b", monitored, ""); indexPath != stateDir {
+		t.Errorf("IndexPath = %s, want %s for a new index", indexPath, stateDir)
+	}
+	writeFiles(t, legacy, map[string]string{"index.db": ""})
+	if indexPath := IndexPath("a/b", monitored, ""); indexPath != legacy {
+		t.Errorf("IndexPath = %s, want the legacy %s", indexPath, legacy)
+	}
+	if indexPath := IndexPath("a/b", monitored, "/configured"); indexPath != "/configured" {
+		t.Errorf("IndexPath = %s, want the configured path over the legacy one", indexPath)
+	}
+	// once moved, the legacy index is left alone
+	writeFiles(t, stateDir, map[string]string{"index.db": ""})
+	if indexPath := IndexPath("a/b", monitored, ""); indexPath != stateDir {
+		t.Errorf("IndexPath = %s, want %s", indexPath, stateDir)
+	}
+
+	t.Setenv("XDG_STATE_HOME", "")
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	if indexPath, want := IndexPath("a", t.TempDir(), ""), filepath.Join(home, ".local", "state", "gsyncd", "a"); indexPath != want {
+		t.Errorf("IndexPath = %s without XDG_STATE_HOME, want %s", indexPath, want)
+	}
+}
+
+func filePaths(files []IndexedFile) map[string]bool {
+	paths := make(map[string]bool)
+	for _, file := range files {
+		paths[file.FilePath] = true
+	}
+	return paths
+}
@@ -0,0 +1,377 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// The kinds of watcher a monitor can use, see NewWatcher.
+const (
+	WATCHER_AUTO     = "auto"
+	WATCHER_FSNOTIFY = "fsnotify"
+	WATCHER_POLL     = "poll"
+)
+
+// POLL_INTERVAL is the default for how often a polling watcher looks at the
+// directories it watches.
+const POLL_INTERVAL = 10 * time.Second
+
+// Watcher reports the changes to the entries of the directories added to
+// it, the way fsnotify.Watcher does. Subdirectories have to be added on
+// their own.
+type Watcher interface {
+	Add(dir string) error
+	Remove(dir string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	// Close stops the watcher, Events is closed once it has stopped.
+	Close() error
+}
+
+// NewWatcher returns a watcher of kind for the monitored directory dir.
+// WATCHER_FSNOTIFY uses fsnotify and WATCHER_POLL looks at the watched
+// directories every interval, which also sees changes fsnotify doesn't,
+// made on network and FUSE filesystems or by other hosts. WATCHER_AUTO polls
+// dir if it is on such a filesystem and uses fsnotify otherwise, falling
+// back to polling once a directory can't be added to it, as when the limit
+// of inotify watches is reached.
+func NewWatcher(kind string, dir string, interval time.Duration) (Watcher, error) {
+	if interval <= 0 {
+		interval = POLL_INTERVAL
+	}
+	switch kind {
+	case WATCHER_FSNOTIFY:
+		return newFsnotifyWatcher()
+	case WATCHER_POLL:
+		return newPollWatcher(interval), nil
+	case WATCHER_AUTO, "":
+		if fsType := remoteFS(dir); fsType != "" {
+			fmt.Println(dir, "is on", fsType+", polling it every", interval)
+			return newPollWatcher(interval), nil
+		}
+		return newAutoWatcher(dir, interval), nil
+	}
+	return nil, fmt.Errorf("unknown watcher %q, use %s, %s or %s", kind, WATCHER_AUTO, WATCHER_FSNOTIFY, WATCHER_POLL)
+}
+
+type fsnotifyWatcher struct {
+	w *fsnotify.Watcher
+}
+
+func newFsnotifyWatcher() (Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return fsnotifyWatcher{w}, nil
+}
+
+func (w fsnotifyWatcher) Add(dir string) error {
+	return w.w.Add(dir)
+}
+
+func (w fsnotifyWatcher) Remove(dir string) error {
+	return w.w.Remove(dir)
+}
+
+func (w fsnotifyWatcher) Events() <-chan fsnotify.Event {
+	return w.w.Events
+}
+
+func (w fsnotifyWatcher) Errors() <-chan error {
+	return w.w.Errors
+}
+
+func (w fsnotifyWatcher) Close() error {
+	return w.w.Close()
+}
+
+// pollWatcher finds changes by comparing the entries of each watched
+// directory with what they were at the previous poll. An entry that is gone
+// is reported as renamed, so ProcessEvent recognizes it by its inode when it
+// shows up under another name in the same poll.
+type pollWatcher struct {
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+	stopped  chan struct{}
+	mu       sync.Mutex
+	dirs     map[string]map[string]polledEntry // watched directory: its entries by name
+}
+
+type polledEntry struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+	inode   uint64
+}
+
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		dirs:     make(map[string]map[string]polledEntry),
+	}
+	go w.run()
+	return w
+}
+
+// Add starts polling dir from its current entries.
+func (w *pollWatcher) Add(dir string) error {
+	entries, err := pollDir(dir)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[filepath.Clean(dir)] = entries
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *pollWatcher) Remove(dir string) error {
+	w.mu.Lock()
+	delete(w.dirs, filepath.Clean(dir))
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *pollWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *pollWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *pollWatcher) Close() error {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	<-w.stopped
+	return nil
+}
+
+func (w *pollWatcher) run() {
+	defer func() {
+		close(w.events)
+		close(w.errors)
+		close(w.stopped)
+	}()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-time.After(w.interval):
+		}
+		for _, ev := range w.poll() {
+			select {
+			case w.events <- ev:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// poll returns the changes since the previous poll: the entries that are
+// gone first, then the new ones, then the changed ones, so a move between
+// two directories is reported in the order fsnotify reports it.
+func (w *pollWatcher) poll() []fsnotify.Event {
+	w.mu.Lock()
+	dirs := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	w.mu.Unlock()
+	var gone, created, written []fsnotify.Event
+	for _, dir := range dirs {
+		entries, err := pollDir(dir)
+		w.mu.Lock()
+		previous, ok := w.dirs[dir]
+		if ok {
+			if err != nil {
+				// gone itself, its parent reports it
+				delete(w.dirs, dir)
+			} else {
+				w.dirs[dir] = entries
+			}
+		}
+		w.mu.Unlock()
+		if !ok || err != nil {
+			continue
+		}
+		for name := range previous {
+			if _, ok := entries[name]; !ok {
+				gone = append(gone, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Rename})
+			}
+		}
+		for name, entry := range entries {
+			old, ok := previous[name]
+			if !ok || old.inode != entry.inode {
+				created = append(created, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Create})
+			} else if old != entry {
+				written = append(written, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Write})
+			}
+		}
+	}
+	return append(append(gone, created...), written...)
+}
+
+// pollDir returns the entries of dir.
+func pollDir(dir string) (map[string]polledEntry, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]polledEntry, len(names))
+	for _, name := range names {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		_, inode := fileStat(info)
+		entries[name] = polledEntry{info.Size(), info.ModTime(), info.Mode(), inode}
+	}
+	return entries, nil
+}
+
+// autoWatcher uses fsnotify until a directory can't be added to it, then
+// polls every directory added so far and from then on. Changes made while
+// it switches are left to the patrol.
+type autoWatcher struct {
+	dir      string
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+	forwards sync.WaitGroup
+	mu       sync.Mutex
+	current  Watcher
+	polling  bool
+	added    map[string]bool
+}
+
+func newAutoWatcher(dir string, interval time.Duration) *autoWatcher {
+	w := &autoWatcher{
+		dir:      dir,
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		added:    make(map[string]bool),
+	}
+	current, err := newFsnotifyWatcher()
+	if err != nil {
+		fmt.Printf("Failed to watch %s: %v, polling it every %v instead\n", dir, err, interval)
+		current, w.polling = newPollWatcher(interval), true
+	}
+	w.use(current)
+	return w
+}
+
+// use makes current the watcher whose events are forwarded.
+func (w *autoWatcher) use(current Watcher) {
+	w.current = current
+	w.forwards.Add(1)
+	go func() {
+		defer w.forwards.Done()
+		events, errors := current.Events(), current.Errors()
+		for events != nil || errors != nil {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				select {
+				case w.events <- ev:
+				case <-w.done:
+					return
+				}
+			case err, ok := <-errors:
+				if !ok {
+					errors = nil
+					continue
+				}
+				select {
+				case w.errors <- err:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (w *autoWatcher) Add(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.current.Add(dir)
+	if err == nil || w.polling || os.IsNotExist(err) {
+		// a directory removed since it was found doesn't need a watch
+		if err == nil {
+			w.added[dir] = true
+		}
+		return err
+	}
+	fmt.Printf("Failed to watch %s: %v, polling %s every %v instead\n", dir, err, w.dir, w.interval)
+	poller := newPollWatcher(w.interval)
+	for added := range w.added {
+		poller.Add(added)
+	}
+	w.current.Close()
+	w.use(poller)
+	w.polling = true
+	if err := poller.Add(dir); err != nil {
+		return err
+	}
+	w.added[dir] = true
+	return nil
+}
+
+func (w *autoWatcher) Remove(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.added, dir)
+	return w.current.Remove(dir)
+}
+
+func (w *autoWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+func (w *autoWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *autoWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	close(w.done)
+	err := w.current.Close()
+	w.forwards.Wait()
+	close(w.events)
+	close(w.errors)
+	return err
+}
@@ -0,0 +1,141 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// failingWatcher fails to add directories the way fsnotify does once the
+// inotify watches run out.
+type failingWatcher struct{ Watcher }
+
+func (failingWatcher) Add(dir string) error { return syscall.ENOSPC }
+
+// waitEvents reads events from w until it has one of each of want.
+func waitEvents(t *testing.T, w Watcher, want ...fsnotify.Event) {
+	missing := make(map[fsnotify.Event]bool)
+	for _, ev := range want {
+		missing[ev] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for len(missing) > 0 {
+		select {
+		case ev := <-w.Events():
+			delete(missing, ev)
+		case <-timeout:
+			t.Fatalf("no events %v", missing)
+		}
+	}
+}
+
+func TestPollWatcherPoll(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"moved": "moved", "del": "del", "changed": "changed", "a/kept": "kept", "b/unwatched": "x"})
+	w := newPollWatcher(time.Hour)
+	defer w.Close()
+	for _, watched := range []string{dir, filepath.Join(dir, "a"), filepath.Join(dir, "b")} {
+		if err := w.Add(watched); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Add(filepath.Join(dir, "missing")); err == nil {
+		t.Error("added a directory that doesn't exist")
+	}
+	w.Remove(filepath.Join(dir, "b"))
+
+	os.Rename(filepath.Join(dir, "moved"), filepath.Join(dir, "a", "moved"))
+	os.Remove(filepath.Join(dir, "del"))
+	writeFiles(t, dir, map[string]string{"new": "new", "changed": "changed more", "b/new": "x"})
+	events := w.poll()
+	want := map[fsnotify.Event]int{
+		{Name: filepath.Join(dir, "moved"), Op: fsnotify.Rename}:      0,
+		{Name: filepath.Join(dir, "del"), Op: fsnotify.Rename}:        0,
+		{Name: filepath.Join(dir, "a", "moved"), Op: fsnotify.Create}: 1,
+		{Name: filepath.Join(dir, "new"), Op: fsnotify.Create}:        1,
+		{Name: filepath.Join(dir, "changed"), Op: fsnotify.Write}:     2,
+	}
+	last := 0
+	for _, ev := range events {
+		order, ok := want[ev]
+		if !ok {
+			// a directory whose entries changed is written
+			if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() && ev.Op == fsnotify.Write {
+				continue
+			}
+			t.Errorf("unexpected %v", ev)
+			continue
+		}
+		if order < last {
+			t.Errorf("%v after the events of a later kind", ev)
+		}
+		last = order
+		delete(want, ev)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing %v in %v", want, events)
+	}
+	if events := w.poll(); len(events) > 0 {
+		t.Errorf("polled %v without changes", events)
+	}
+}
+
+func TestPollWatcherRun(t *testing.T) {
+	dir := t.TempDir()
+	w := newPollWatcher(10 * time.Millisecond)
+	if err := w.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"new": "new"})
+	waitEvents(t, w, fsnotify.Event{Name: filepath.Join(dir, "new"), Op: fsnotify.Create})
+	w.Close()
+	if _, ok := <-w.Events(); ok {
+		t.Error("Events is open after Close")
+	}
+}
+
+func TestAutoWatcherFallback(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a/x": "x"})
+	w := newAutoWatcher(dir, 10*time.Millisecond)
+	defer w.Close()
+	if w.polling {
+		t.Skip("fsnotify isn't available")
+	}
+	if err := w.Add(filepath.Join(dir, "missing")); !os.IsNotExist(err) || w.polling {
+		t.Fatalf("adding a directory that doesn't exist returned %v, polling %v", err, w.polling)
+	}
+	if err := w.Add(dir); err != nil || w.polling {
+		t.Fatalf("adding %s returned %v, polling %v", dir, err, w.polling)
+	}
+	w.current = failingWatcher{w.current}
+	if err := w.Add(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if !w.polling {
+		t.Fatal("still using fsnotify after it failed")
+	}
+	// both the directory added before and the one that failed are polled
+	writeFiles(t, dir, map[string]string{"y": "y", "a/z": "z"})
+	waitEvents(t, w,
+		fsnotify.Event{Name: filepath.Join(dir, "y"), Op: fsnotify.Create},
+		fsnotify.Event{Name: filepath.Join(dir, "a", "z"), Op: fsnotify.Create})
+}
+
+func TestNewWatcher(t *testing.T) {
+	if _, err := NewWatcher("inotify", t.TempDir(), 0); err == nil {
+		t.Error("made a watcher of an unknown kind")
+	}
+	w, err := NewWatcher(WATCHER_POLL, t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if poller, ok := w.(*pollWatcher); !ok || poller.interval != POLL_INTERVAL {
+		t.Errorf("NewWatcher(%s) = %T", WATCHER_POLL, w)
+	}
+}
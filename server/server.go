@@ -0,0 +1,280 @@
+// Package server serves directories to gsync clients. A Server indexes the
+// directories of its monitors, keeps their indexes up to date and serves
+// them over http, on its own or mounted in another http server.
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/elgs/filesync/api"
+	"github.com/elgs/filesync/index"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Options configure a Server.
+type Options struct {
+	// IP and Port are where Start listens, 127.0.0.1 and 6776 if zero.
+	IP   string
+	Port int
+	// IndexStore is the kind of index store of the monitors, see
+	// index.OpenStore.
+	IndexStore string
+}
+
+// MonitorOptions configure a monitored directory. Zero durations turn
+// debouncing and the patrol off, NewMonitorOptions has the defaults.
+type MonitorOptions struct {
+	Path string
+	// IndexPath is where the index is kept, see index.IndexPath.
+	IndexPath string
+	// BlockStore keeps the blocks of the files, History implies it.
+	BlockStore     bool
+	History        *index.History
+	WriteQuiet     time.Duration
+	WriteMaxWait   time.Duration
+	Workers        int
+	QueueSize      int
+	PatrolInterval time.Duration
+	PatrolBatch    int
+	// Watcher is the kind of watcher, see index.NewWatcher.
+	Watcher      string
+	PollInterval time.Duration
+}
+
+// NewMonitorOptions returns the default options of a monitor of path.
+func NewMonitorOptions(path string) MonitorOptions {
+	return MonitorOptions{
+		Path:           path,
+		WriteQuiet:     index.WRITE_QUIET,
+		WriteMaxWait:   index.WRITE_MAX_WAIT,
+		Workers:        index.INDEX_WORKERS,
+		QueueSize:      index.INDEX_QUEUE_SIZE,
+		PatrolInterval: index.PATROL_INTERVAL,
+		PatrolBatch:    index.PATROL_BATCH,
+		Watcher:        index.WATCHER_AUTO,
+		PollInterval:   index.POLL_INTERVAL,
+	}
+}
+
+// Server serves its monitors by their api key. Monitors can be added and
+// removed while it serves.
+type Server struct {
+	options    Options
+	handler    http.Handler
+	mu         sync.RWMutex
+	monitors   map[string]*monitor
+	httpServer *http.Server
+}
+
+type monitor struct {
+	*index.Monitor
+	watcher index.Watcher
+	// done is closed once the events of watcher are no longer processed
+	done chan struct{}
+	// requests counts the requests being served from the monitor
+	requests sync.WaitGroup
+}
+
+// New returns a server without monitors, see AddMonitor and Start.
+func New(options Options) *Server {
+	s := &Server{
+		options:  options,
+		monitors: make(map[string]*monitor),
+	}
+	s.handler = api.Handler(s.acquire)
+	return s
+}
+
+// AddMonitor indexes the directory of options, watches it and serves it to
+// clients with key. The directory is scanned before it returns.
+func (s *Server) AddMonitor(key string, options MonitorOptions) error {
+	s.mu.RLock()
+	_, exists := s.monitors[key]
+	s.mu.RUnlock()
+	if exists {
+		return fmt.Errorf("monitor %s exists already", key)
+	}
+	monitored := index.PathSafe(options.Path)
+	indexPath := index.IndexPath(key, monitored, options.IndexPath)
+	store, err := index.OpenStore(s.options.IndexStore, indexPath)
+	if err != nil {
+		return err
+	}
+	m := &monitor{
+		Monitor: &index.Monitor{
+			Monitored:      monitored,
+			Store:          store,
+			History:        options.History,
+			WriteQuiet:     options.WriteQuiet,
+			WriteMaxWait:   options.WriteMaxWait,
+			Workers:        options.Workers,
+			QueueSize:      options.QueueSize,
+			PatrolInterval: options.PatrolInterval,
+			PatrolBatch:    options.PatrolBatch,
+		},
+		done: make(chan struct{}),
+	}
+	if options.BlockStore || options.History != nil {
+		// versions are kept as blocks
+		if m.Blocks, err = index.OpenBlockStore(filepath.Join(indexPath, "blocks")); err != nil {
+			store.Close()
+			return err
+		}
+	}
+	if m.watcher, err = index.NewWatcher(options.Watcher, monitored, options.PollInterval); err != nil {
+		store.Close()
+		return err
+	}
+	started := time.Now()
+	walked, err := index.WatchRecursively(m.watcher, monitored, m.Monitor)
+	if err != nil {
+		fmt.Println(err)
+	}
+	elapsed := time.Since(started)
+	fmt.Printf("Scanned %d entries in %s in %v (%.0f/s)\n", walked, monitored, elapsed, float64(walked)/elapsed.Seconds())
+
+	s.mu.Lock()
+	if _, exists := s.monitors[key]; exists {
+		s.mu.Unlock()
+		m.watcher.Close()
+		store.Close()
+		return fmt.Errorf("monitor %s exists already", key)
+	}
+	s.monitors[key] = m
+	s.mu.Unlock()
+	go func() {
+		defer close(m.done)
+		index.ProcessEvent(m.watcher, m.Monitor)
+	}()
+	return nil
+}
+
+// RemoveMonitor stops serving and watching the monitor key, and closes its
+// index once the files being indexed and the requests being served from it
+// are done. It waits for them until ctx is done, the index is left open if
+// they take longer.
+func (s *Server) RemoveMonitor(ctx context.Context, key string) error {
+	s.mu.Lock()
+	m, ok := s.monitors[key]
+	delete(s.monitors, key)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown monitor %s", key)
+	}
+	err := m.watcher.Close()
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		return fmt.Errorf("monitor %s is still indexing: %v", key, ctx.Err())
+	}
+	served := make(chan struct{})
+	go func() {
+		m.requests.Wait()
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-ctx.Done():
+		return fmt.Errorf("monitor %s is still serving requests: %v", key, ctx.Err())
+	}
+	if closeErr := m.Store.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Monitor returns the monitor key, nil if there is none.
+func (s *Server) Monitor(key string) *index.Monitor {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if m, ok := s.monitors[key]; ok {
+		return m.Monitor
+	}
+	return nil
+}
+
+// acquire returns the monitor key for a request, nil if there is none, and
+// the func that releases it once the request is done. The index of the
+// monitor stays open until then.
+func (s *Server) acquire(key string) (*index.Monitor, func()) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.monitors[key]
+	if !ok {
+		return nil, nil
+	}
+	// counted under the lock, so RemoveMonitor waits for it
+	m.requests.Add(1)
+	return m.Monitor, m.requests.Done
+}
+
+// Keys returns the keys of the monitors, sorted.
+func (s *Server) Keys() []string {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.monitors))
+	for key := range s.monitors {
+		keys = append(keys, key)
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// Handler returns the api of the server, to be mounted in another http
+// server instead of calling Start.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Start listens on the ip and port of the options and serves the api in the
+// background.
+func (s *Server) Start() error {
+	ip, port := s.options.IP, s.options.Port
+	if ip == "" {
+		ip = "127.0.0.1"
+	}
+	if port == 0 {
+		port = 6776
+	}
+	listener, err := net.Listen("tcp", fmt.Sprint(ip, ":", port))
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: s.handler}
+	s.mu.Lock()
+	s.httpServer = httpServer
+	s.mu.Unlock()
+	go func() {
+		if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+			fmt.Println(err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops serving, waits for the requests being served, then
+// removes every monitor, waiting for the files being indexed. Connections
+// still open are closed and indexes still busy are left open once ctx is
+// done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.RLock()
+	httpServer := s.httpServer
+	s.mu.RUnlock()
+	var err error
+	if httpServer != nil {
+		if err = httpServer.Shutdown(ctx); err != nil {
+			httpServer.Close()
+		}
+	}
+	for _, key := range s.Keys() {
+		if removeErr := s.RemoveMonitor(ctx, key); err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
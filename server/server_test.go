@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"github.com/elgs/filesync/index"
+	"testing"
+	"time"
+)
+
+func TestRemoveMonitorWaitsForRequests(t *testing.T) {
+	s := New(Options{IndexStore: "memory"})
+	options := NewMonitorOptions(t.TempDir())
+	options.Watcher = index.WATCHER_POLL
+	if err := s.AddMonitor("k", options); err != nil {
+		t.Fatal(err)
+	}
+	m, release := s.acquire("k")
+	if m == nil {
+		t.Fatal("the monitor wasn't found")
+	}
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- s.RemoveMonitor(context.Background(), "k")
+	}()
+	select {
+	case err := <-removed:
+		t.Fatalf("removed while a request is served: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// no new requests reach it meanwhile, the one being served still can
+	// read the index
+	if other, _ := s.acquire("k"); other != nil {
+		t.Fatal("a monitor being removed was found")
+	}
+	if _, err := m.Store.ChangedDirs(0); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not removed after the request was done")
+	}
+
+	// a remove that runs out of time leaves the index open
+	if err := s.AddMonitor("k", options); err != nil {
+		t.Fatal(err)
+	}
+	m, release = s.acquire("k")
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.RemoveMonitor(ctx, "k"); err == nil {
+		t.Fatal("removed while a request is served")
+	}
+	if _, err := m.Store.ChangedDirs(0); err != nil {
+		t.Fatal(err)
+	}
+}